@@ -22,6 +22,7 @@ fi
 
 go get github.com/golang/protobuf/protoc-gen-go
 go get google.golang.org/grpc
+go get github.com/grpc-ecosystem/grpc-gateway/v2/protoc-gen-grpc-gateway
 
 go get github.com/googleapis/gapic-generator-go/cmd/protoc-gen-go_gapic
 pushd $GOPATH/src/github.com/googleapis/gapic-generator-go
@@ -41,6 +42,7 @@ protoc protos/kiosk.proto \
   --include_source_info \
   --descriptor_set_out=generated/kiosk_descriptor.pb \
   --go_out=plugins=grpc:$GOPATH/src \
+  --grpc-gateway_out $GOPATH/src \
   --go_gapic_out $GOPATH/src/ \
   --go_gapic_opt 'go-gapic-package=github.com/googleapis/kiosk/gapic;gapic' \
   --go_cli_out kctl/ \
@@ -21,7 +21,6 @@ import 'package:args/args.dart';
 import 'package:grpc/grpc.dart';
 import 'package:kiosk/src/generated/kiosk.pb.dart';
 import 'package:kiosk/src/generated/kiosk.pbgrpc.dart';
-import 'package:kiosk/src/generated/google/protobuf/empty.pb.dart';
 
 Future<Null> main(List<String> args) async {
   if (args.length == 0) {
@@ -85,11 +84,11 @@ Future<Null> main(List<String> args) async {
   try {
     switch (command) {
       case "list-kiosks":
-        final response = await stub.listKiosks(new Empty());
+        final response = await stub.listKiosks(new ListKiosksRequest());
         print('Received: ${response}');
         break;
       case "list-signs":
-        final response = await stub.listSigns(new Empty());
+        final response = await stub.listSigns(new ListSignsRequest());
         print('Received: ${response}');
         break;
       case "create-kiosk":
@@ -136,18 +136,20 @@ void manage(SendPort listener) async {
         var kioskIds = data[0];
         var signId = data[1];
         if (kioskIds.isEmpty) {
-          for (var kioskId = 1; kioskId < nextKioskId; kioskId++) {
-            signIdsForKioskIds[kioskId] = signId;
-            notify(subscribers[kioskId], signId);
-          }
-        } else {
-          for (var kioskId in kioskIds) {
-            signIdsForKioskIds[kioskId] = signId;
-            notify(subscribers[kioskId], signId);
+          kioskIds = List<int>.generate(nextKioskId - 1, (i) => i + 1);
+        }
+        var reply = SetSignIdForKioskIdsResponse();
+        for (var kioskId in kioskIds) {
+          if (signIdsForKioskIds[kioskId] == signId) {
+            reply.unchangedKioskIds.add(kioskId);
+            continue;
           }
+          signIdsForKioskIds[kioskId] = signId;
+          reply.changedKioskIds.add(kioskId);
+          notify(subscribers[kioskId], signId);
         }
-        // reply with the Empty() message
-        replyTo.send(Empty());
+        // reply with the kiosks that were and weren't changed
+        replyTo.send(reply);
         break;
       case Command.get_sign_id_for_kiosk_id:
         var reply = GetSignIdResponse();
@@ -188,6 +190,15 @@ class DisplayService extends DisplayServiceBase {
 
   DisplayService(this.dataManagerSendPort);
 
+  // This server only implements the basic kiosk, sign and assignment
+  // methods. The rest of the Display service is answered with UNIMPLEMENTED;
+  // see the Go server for a complete implementation.
+  @override
+  noSuchMethod(Invocation invocation) {
+    throw grpc.GrpcError.unimplemented(
+        '${invocation.memberName} is not implemented by this server.');
+  }
+
   createKiosk(call, request) async {
     // FIXME: This should be a direct return (no "then"),
     // but sendReceive() returns Future<dynamic> and we need FutureOr<Kiosk>.
@@ -257,7 +268,7 @@ class DisplayService extends DisplayServiceBase {
     // but we can't because of this: https://github.com/dart-lang/protobuf/issues/167
     return sendReceive(dataManagerSendPort, Command.set_sign_id_for_kiosk_ids,
         [request.kioskIds, request.signId]).then((msg) {
-      return Empty();
+      return msg;
     });
   }
 
@@ -20,12 +20,13 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"time"
 
-	"github.com/golang/protobuf/ptypes/empty"
 	pb "github.com/googleapis/kiosk/generated"
 	"google.golang.org/grpc"
 )
@@ -44,20 +45,27 @@ func address() string {
 	return address
 }
 
-func create_sign(ctx context.Context, c pb.DisplayClient, name string, path string) {
+// runID prefixes the request ids of the signs created by a run, so that
+// they aren't mistaken for retries of the signs created by an earlier run.
+var runID = newRunID()
+
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func new_sign(name string, path string) *pb.Sign {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		panic(err)
 	}
-	sign := &pb.Sign{
-		Name:  name,
-		Text:  name,
-		Image: b,
-	}
-	fmt.Printf("creating sign %s\n", sign.Name)
-	_, err = c.CreateSign(ctx, sign)
-	if err != nil {
-		panic(err)
+	fmt.Printf("creating sign %s\n", name)
+	return &pb.Sign{
+		Name:      name,
+		Text:      name,
+		Image:     b,
+		RequestId: runID + "-" + name,
 	}
 }
 
@@ -75,24 +83,34 @@ func main() {
 
 	// Delete all signs.
 	{
-		response, err := c.ListSigns(ctx, &empty.Empty{})
+		response, err := c.ListSigns(ctx, &pb.ListSignsRequest{})
 		if err != nil {
 			panic(err)
 		}
+		request := &pb.BatchDeleteSignsRequest{AllOrNothing: true}
 		for _, s := range response.Signs {
 			fmt.Printf("deleting sign %d\n", s.Id)
-			_, err := c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: int32(s.Id)})
-			if err != nil {
-				panic(err)
-			}
+			request.Ids = append(request.Ids, s.Id)
+		}
+		_, err = c.BatchDeleteSigns(ctx, request)
+		if err != nil {
+			panic(err)
 		}
 	}
 	// Create signs for each sample image.
 	{
-		create_sign(ctx, c, "cat", "adorable-animal-cat-20787.jpg")
-		create_sign(ctx, c, "gorilla", "animal-animal-photography-black-35992.jpg")
-		create_sign(ctx, c, "peacock", "animal-avian-beak-326900.jpg")
-		create_sign(ctx, c, "dog", "animal-canine-close-up-733416.jpg")
-		create_sign(ctx, c, "butterfly", "beautiful-bloom-blossom-326067.jpg")
+		_, err := c.BatchCreateSigns(ctx, &pb.BatchCreateSignsRequest{
+			Signs: []*pb.Sign{
+				new_sign("cat", "adorable-animal-cat-20787.jpg"),
+				new_sign("gorilla", "animal-animal-photography-black-35992.jpg"),
+				new_sign("peacock", "animal-avian-beak-326900.jpg"),
+				new_sign("dog", "animal-canine-close-up-733416.jpg"),
+				new_sign("butterfly", "beautiful-bloom-blossom-326067.jpg"),
+			},
+			AllOrNothing: true,
+		})
+		if err != nil {
+			panic(err)
+		}
 	}
 }
@@ -0,0 +1,174 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	pb "github.com/googleapis/kiosk/generated"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc/codes"
+)
+
+// readRecords reads the items of a batch from a file. A .json file holds an
+// array of objects. Any other file is CSV with a header row that names the
+// columns. Each item is returned as a map from field names to values.
+func readRecords(path string) ([]map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records := []map[string]string{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var items []map[string]interface{}
+		if err := json.Unmarshal(b, &items); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, item := range items {
+			record := make(map[string]string)
+			for key, value := range item {
+				switch v := value.(type) {
+				case string:
+					record[key] = v
+				case float64:
+					record[key] = strconv.FormatFloat(v, 'g', -1, 64)
+				default:
+					return nil, fmt.Errorf("%s: %s must be a string or a number", path, key)
+				}
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+	rows, err := csv.NewReader(strings.NewReader(string(b))).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(rows) == 0 {
+		return records, nil
+	}
+	for _, row := range rows[1:] {
+		record := make(map[string]string)
+		for i, key := range rows[0] {
+			record[strings.TrimSpace(key)] = row[i]
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// number parses a numeric field of a record, which may be missing.
+func number(record map[string]string, key string) (float64, error) {
+	if record[key] == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(record[key], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", key, record[key])
+	}
+	return v, nil
+}
+
+// readKiosks reads kiosks with the fields name, width, height, latitude and
+// longitude.
+func readKiosks(path string) ([]*pb.Kiosk, error) {
+	records, err := readRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	kiosks := []*pb.Kiosk{}
+	for _, record := range records {
+		kiosk := &pb.Kiosk{Name: record["name"], RequestId: newRequestID()}
+		var v [4]float64
+		for i, key := range []string{"width", "height", "latitude", "longitude"} {
+			if v[i], err = number(record, key); err != nil {
+				return nil, err
+			}
+		}
+		if record["width"] != "" || record["height"] != "" {
+			kiosk.Size = &pb.ScreenSize{Width: int32(v[0]), Height: int32(v[1])}
+		}
+		if record["latitude"] != "" || record["longitude"] != "" {
+			kiosk.Location = &latlng.LatLng{Latitude: v[2], Longitude: v[3]}
+		}
+		kiosks = append(kiosks, kiosk)
+	}
+	return kiosks, nil
+}
+
+// readSigns reads signs with the fields name, text and image, which is the
+// name of an image file relative to the batch file.
+func readSigns(path string) ([]*pb.Sign, error) {
+	records, err := readRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	signs := []*pb.Sign{}
+	for _, record := range records {
+		sign := &pb.Sign{Name: record["name"], Text: record["text"], RequestId: newRequestID()}
+		if image := record["image"]; image != "" {
+			if !filepath.IsAbs(image) {
+				image = filepath.Join(filepath.Dir(path), image)
+			}
+			if sign.Image, err = ioutil.ReadFile(image); err != nil {
+				return nil, err
+			}
+		}
+		signs = append(signs, sign)
+	}
+	return signs, nil
+}
+
+// readIds reads the id field of each item of a batch.
+func readIds(path string) ([]int32, error) {
+	records, err := readRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int32{}
+	for _, record := range records {
+		id, err := strconv.Atoi(record["id"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", record["id"])
+		}
+		ids = append(ids, int32(id))
+	}
+	return ids, nil
+}
+
+// printStatuses prints the status of each item of a batch, with a
+// description of the items that succeeded.
+func printStatuses(statuses []*status.Status, describe func(i int) string) {
+	failed := 0
+	for i, st := range statuses {
+		if code := codes.Code(st.Code); code != codes.OK {
+			fmt.Printf("%d: %s %s\n", i, code, st.Message)
+			failed++
+		} else {
+			fmt.Printf("%d: OK %s\n", i, describe(i))
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d items failed\n", failed, len(statuses))
+	}
+}
@@ -17,13 +17,18 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
@@ -71,27 +76,148 @@ func Match(a map[string]interface{}, command string) bool {
 	return true
 }
 
+// requestID returns the id given with --request-id, so that a command that
+// failed can be retried without creating a second resource, or else a
+// random id for a create request so that the server can recognize retries
+// of it.
+func requestID(args docopt.Opts) string {
+	if id, err := args.String("--request-id"); err == nil && id != "" {
+		return id
+	}
+	return newRequestID()
+}
+
+// newRequestID returns a random id for a create request.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTime parses an RFC 3339 time or a duration before now.
+func parseTime(value string) (*timestamp.Timestamp, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return ptypes.TimestampProto(time.Now().Add(-d))
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return ptypes.TimestampProto(t)
+}
+
 func main() {
 	usage := `Kiosk Tool.
 
   Usage:
-    k create kiosk <name>
-    k list kiosks
+    k create kiosk <name> [--request-id=<id>]
+    k create kiosks <file> [--all-or-nothing]
+    k list kiosks [--show-deleted] [--offline-since=<duration>]
     k get kiosk <kiosk_id>
-    k delete kiosk <kiosk_id>
-    k create sign <name> [--text=<text>] [--image=<image>]
-    k list signs
+    k update kiosk <kiosk_id> [--name=<name>] [--etag=<etag>] [--var=<variable>...]
+    k delete kiosk <kiosk_id> [--etag=<etag>]
+    k undelete kiosk <kiosk_id>
+    k delete kiosks <file> [--all-or-nothing]
+    k create sign <name> [--text=<text>] [--image=<image>] [--template=<template_id>] [--request-id=<id>]
+    k create signs <file> [--all-or-nothing]
+    k list signs [--show-deleted]
     k get sign <sign_id>
-    k delete sign <sign_id>
-    k set sign <sign_id> for kiosk <kiosk_id>
-    k set sign <sign_id> for all kiosks
+    k update sign <sign_id> [--name=<name>] [--text=<text>] [--image=<image>] [--template=<template_id>] [--etag=<etag>]
+    k delete sign <sign_id> [--etag=<etag>]
+    k undelete sign <sign_id>
+    k delete signs <file> [--all-or-nothing]
+    k list sign revisions <sign_id>
+    k get sign revision <sign_id> <revision_id> [--output=<file>]
+    k rollback sign <sign_id> to <revision_id> [--etag=<etag>]
+    k create template <name> [--text=<text>] [--image=<image>] [--overlay=<overlay>...]
+    k list templates
+    k get template <template_id>
+    k update template <template_id> [--name=<name>] [--text=<text>] [--image=<image>] [--overlay=<overlay>...] [--etag=<etag>]
+    k delete template <template_id> [--etag=<etag>]
+    k create layout <name> --region=<region>...
+    k list layouts
+    k get layout <layout_id>
+    k delete layout <layout_id>
+    k set layout <layout_id> for kiosk <kiosk_id> [--region-sign=<region_sign>...]
+    k get layout for kiosk <kiosk_id>
+    k set sign <sign_id> for kiosk <kiosk_id> [--etag=<etag>] [--revision=<revision_id>] [--var=<variable>...]
+    k set sign <sign_id> for all kiosks [--var=<variable>...]
     k get sign for kiosk <kiosk_id>
+    k get effective sign for kiosk <kiosk_id> [--in-region=<region>]
+    k set data <key> <value>
+    k get data <key>
+    k list data
+    k delete data <key>
     k get signs for kiosk <kiosk_id>
+    k get manifest for kiosk <kiosk_id>
+    k connect kiosk <kiosk_id>
+    k kiosk <kiosk_id> command (refresh|clear-cache|identify|restart-app|reboot|screenshot)
+    k kiosk <kiosk_id> commands
+    k list screenshots for kiosk <kiosk_id>
+    k get screenshot for kiosk <kiosk_id> [--id=<screenshot_id>] [--output=<file>]
+    k upload screenshot for kiosk <kiosk_id> --image=<image> [--command=<command_id>]
+    k report kiosk <kiosk_id> showing sign <sign_id> [--revision=<revision_id>]
+    k report kiosk <kiosk_id> played sign <sign_id> [--revision=<revision_id>] [--duration=<duration>]
+    k plays [--sign=<sign_id>] [--kiosk=<kiosk_id>] [--since=<time>] [--until=<time>] [--output=<file>]
+    k rollout sign <sign_id> --stages=<stages> [--kiosks=<kiosk_ids>] [--revision=<revision_id>]
+    k rollout list
+    k rollout status <rollout_id>
+    k rollout (advance|pause|resume|abort) <rollout_id>
+    k emergency override sign <sign_id> [--revision=<revision_id>] [--near=<location> --radius=<meters>] [--reason=<reason>]
+    k emergency list
+    k emergency clear <override_id>
+    k audit [--resource=<resource>] [--principal=<principal>] [--since=<time>] [--until=<time>] [--limit=<n>]
 
   Options:
     <name> Name for new kiosk or sign.
     --text=<text> Text to display on a sign.
-    --image=<image> Image (PNG file) to display on a sign.
+    --image=<image> Image (PNG file) to display on a sign or template, or upload
+                    as a screenshot.
+    --template=<template_id>  Make a sign from a template, or 0 for none.
+    --overlay=<overlay>  Text to draw over the image of a template, as x,y,text
+                         with x and y as fractions of the screen, e.g. 0.1,0.9,{{price}}.
+    --var=<variable>  A template variable of a kiosk or assignment, as name=value.
+                      A kiosk variable with an empty value is removed.
+    --region=<region>  A region of a layout, as name,x,y,width,height with
+                       fractions of the screen, e.g. ticker,0,0.9,1,0.1.
+    --region-sign=<region_sign>  A sign to show in a region of a kiosk's layout,
+                                 as region=sign_id. Other regions show the
+                                 kiosk's own sign. Use layout 0 for none.
+    --in-region=<region>  Get the sign of a region of the kiosk's layout.
+    --name=<name> New name for a kiosk, sign or template.
+    --etag=<etag> Only make a change if the etag of the kiosk, sign, template
+                  or assignment still matches.
+    --show-deleted  Also list deleted kiosks or signs.
+    --offline-since=<duration>  Only list kiosks that have been offline for at
+                                least a duration, e.g. 10m.
+    -o <file>, --output=<file>  Write the image of a sign revision or screenshot,
+                                or play reports as CSV, to a file.
+    --id=<screenshot_id>  Get a screenshot instead of the latest one.
+    --command=<command_id>  The screenshot command that a screenshot answers.
+    --revision=<revision_id>  Display a revision of a sign instead of its latest one.
+    --stages=<stages>  Percentages of kiosks for each stage of a rollout, each
+                       with an optional wait before the next, e.g. 5:1h,25:1h,100.
+                       Stages without a wait need "k rollout advance".
+    --kiosks=<kiosk_ids>  Comma-separated kiosks to roll out to, in order
+                          (all kiosks in a random order by default).
+    --duration=<duration>  How long a sign was on the screen, e.g. 30s.
+    --sign=<sign_id>  Only report plays of a sign.
+    --kiosk=<kiosk_id>  Only report plays on a kiosk.
+    --near=<location>  Only override kiosks near a latitude and longitude,
+                       e.g. 40.7,-74.0.
+    --radius=<meters>  How near kiosks must be to be overridden.
+    --reason=<reason>  Why signs are being overridden, e.g. "fire drill".
+    --all-or-nothing  Change nothing if any item of a batch would fail.
+    <file> CSV file with a header row, or JSON file with an array of objects.
+           Kiosks have the fields name, width, height, latitude and longitude,
+           signs have name, text and image (an image file), and deletes have id.
+    --resource=<resource> Audit events for a resource, e.g. kiosks/1.
+    --principal=<principal> Audit events made by a principal.
+    --since=<time> Audit events at or after a time (RFC 3339 or a duration ago, e.g. 1h),
+                   or plays on or after the day of the time.
+    --until=<time> Audit events before a time (RFC 3339 or a duration ago),
+                   or plays on or before the day of the time.
+    --limit=<n> Maximum number of the most recent audit events to list.
     
     `
 	args, _ := docopt.ParseDoc(usage)
@@ -150,20 +276,81 @@ func main() {
 	if Match(args, "set sign <sign_id> for kiosk <kiosk_id>") {
 		sign_id, err := args.Int("<sign_id>")
 		kiosk_id, err := args.Int("<kiosk_id>")
-		err = c.SetSignIdForKioskIds(ctx, &pb.SetSignIdForKioskIdsRequest{
+		request := &pb.SetSignIdForKioskIdsRequest{
 			SignId:   int32(sign_id),
 			KioskIds: []int32{int32(kiosk_id)},
-		})
+		}
+		if etag, err := args.String("--etag"); err == nil {
+			request.Etags = map[int32]string{int32(kiosk_id): etag}
+		}
+		if revision_id, err := args.Int("--revision"); err == nil {
+			request.RevisionId = int32(revision_id)
+		}
+		if request.Variables, err = parseVariables(args); !Verify(err) {
+			return
+		}
+		response, err := c.SetSignIdForKioskIds(ctx, request)
 		if Verify(err) {
-			fmt.Printf("Successfully set kiosk %d to sign %d\n", kiosk_id, sign_id)
+			if len(response.ChangedKioskIds) > 0 {
+				fmt.Printf("Successfully set kiosk %d to sign %d\n", kiosk_id, sign_id)
+			} else if len(response.OverriddenKioskIds) > 0 {
+				fmt.Printf("Kiosk %d will show sign %d when its emergency override is cleared\n", kiosk_id, sign_id)
+			} else {
+				fmt.Printf("Kiosk %d was already showing sign %d\n", kiosk_id, sign_id)
+			}
 		}
 	} else if Match(args, "set sign <sign_id> for all kiosks") {
 		sign_id, err := args.Int("<sign_id>")
-		err = c.SetSignIdForKioskIds(ctx, &pb.SetSignIdForKioskIdsRequest{
-			SignId: int32(sign_id),
+		variables, err := parseVariables(args)
+		if !Verify(err) {
+			return
+		}
+		response, err := c.SetSignIdForKioskIds(ctx, &pb.SetSignIdForKioskIdsRequest{
+			SignId:    int32(sign_id),
+			Variables: variables,
 		})
 		if Verify(err) {
 			fmt.Printf("Successfully set all kiosks to sign %d\n", sign_id)
+			fmt.Printf("changed: %v\nunchanged: %v\n", response.ChangedKioskIds, response.UnchangedKioskIds)
+			if len(response.OverriddenKioskIds) > 0 {
+				fmt.Printf("overridden: %v\n", response.OverriddenKioskIds)
+			}
+		}
+	} else if Match(args, "set data <key> <value>") {
+		value, err := c.SetDataValue(ctx, &pb.DataValue{
+			Key:   args["<key>"].(string),
+			Value: args["<value>"].(string),
+		})
+		if Verify(err) {
+			fmt.Printf("%+v\n", value)
+		}
+	} else if Match(args, "get data <key>") {
+		value, err := c.GetDataValue(ctx, &pb.GetDataValueRequest{Key: args["<key>"].(string)})
+		if Verify(err) {
+			fmt.Printf("%+v\n", value)
+		}
+	} else if Match(args, "list data") {
+		response, err := c.ListDataValues(ctx, &empty.Empty{})
+		if Verify(err) {
+			for _, value := range response.Values {
+				fmt.Printf("%+v\n", value)
+			}
+		}
+	} else if Match(args, "delete data <key>") {
+		err = c.DeleteDataValue(ctx, &pb.DeleteDataValueRequest{Key: args["<key>"].(string)})
+		if Verify(err) {
+			fmt.Printf("deleted\n")
+		}
+	} else if Match(args, "get effective sign for kiosk <kiosk_id>") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		region, _ := args.String("--in-region")
+		sign, err := c.GetEffectiveSign(ctx, &pb.GetEffectiveSignRequest{
+			KioskId: int32(kiosk_id),
+			Region:  region,
+		})
+		if Verify(err) {
+			truncate(sign)
+			fmt.Printf("%+v\n", sign)
 		}
 	} else if Match(args, "get sign for kiosk <kiosk_id>") {
 		kiosk_id, err := args.Int("<kiosk_id>")
@@ -173,10 +360,21 @@ func main() {
 		if Verify(err) {
 			fmt.Printf("%+v\n", response)
 		}
+	} else if Match(args, "get manifest for kiosk <kiosk_id>") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		response, err := c.GetKioskManifest(ctx, &pb.GetKioskManifestRequest{
+			KioskId: int32(kiosk_id),
+		})
+		if Verify(err) {
+			for _, entry := range response.Entries {
+				fmt.Printf("%+v\n", entry)
+			}
+		}
 	} else if Match(args, "get signs for kiosk <kiosk_id>") {
 		kiosk_id, err := args.Int("<kiosk_id>")
 		client, err := c.GetSignIdsForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
-			KioskId: int32(kiosk_id),
+			KioskId:        int32(kiosk_id),
+			IncludeRegions: true,
 		})
 		if Verify(err) {
 			for {
@@ -188,16 +386,345 @@ func main() {
 				}
 			}
 		}
+	} else if Match(args, "rollout sign <sign_id>") {
+		sign_id, err := args.Int("<sign_id>")
+		value, _ := args.String("--stages")
+		stages, err := parseStages(value)
+		if !Verify(err) {
+			return
+		}
+		rollout := &pb.Rollout{SignId: int32(sign_id), Stages: stages}
+		if value, err := args.String("--kiosks"); err == nil {
+			if rollout.KioskIds, err = parseKioskIds(value); !Verify(err) {
+				return
+			}
+		}
+		if revision_id, err := args.Int("--revision"); err == nil {
+			rollout.RevisionId = int32(revision_id)
+		}
+		rollout, err = c.CreateRollout(ctx, rollout)
+		if Verify(err) {
+			printRollout(rollout)
+		}
+	} else if Match(args, "emergency override sign <sign_id>") {
+		sign_id, err := args.Int("<sign_id>")
+		request := &pb.EmergencyOverrideRequest{SignId: int32(sign_id)}
+		if revision_id, err := args.Int("--revision"); err == nil {
+			request.RevisionId = int32(revision_id)
+		}
+		if near, err := args.String("--near"); err == nil {
+			radius, _ := args.String("--radius")
+			if request.Region, err = parseRegion(near, radius); !Verify(err) {
+				return
+			}
+		}
+		request.Reason, _ = args.String("--reason")
+		override, err := c.EmergencyOverride(ctx, request)
+		if Verify(err) {
+			printOverride(override)
+		}
+	} else if Match(args, "emergency list") {
+		response, err := c.ListEmergencyOverrides(ctx, &empty.Empty{})
+		if Verify(err) {
+			for _, override := range response.Overrides {
+				printOverride(override)
+			}
+		}
+	} else if Match(args, "emergency clear <override_id>") {
+		id, err := args.Int("<override_id>")
+		override, err := c.ClearEmergencyOverride(ctx, &pb.ClearEmergencyOverrideRequest{Id: int32(id)})
+		if Verify(err) {
+			printOverride(override)
+		}
+	} else if Match(args, "rollout list") {
+		response, err := c.ListRollouts(ctx, &pb.ListRolloutsRequest{})
+		if Verify(err) {
+			for _, rollout := range response.Rollouts {
+				printRollout(rollout)
+			}
+		}
+	} else if Match(args, "rollout status <rollout_id>") {
+		id, err := args.Int("<rollout_id>")
+		rollout, err := c.GetRollout(ctx, &pb.GetRolloutRequest{Id: int32(id)})
+		if Verify(err) {
+			printRollout(rollout)
+			fmt.Printf("kiosks: %v\n", rollout.KioskIds)
+		}
+	} else if Match(args, "rollout advance <rollout_id>") {
+		id, err := args.Int("<rollout_id>")
+		rollout, err := c.AdvanceRollout(ctx, &pb.AdvanceRolloutRequest{Id: int32(id)})
+		if Verify(err) {
+			printRollout(rollout)
+		}
+	} else if Match(args, "rollout pause <rollout_id>") {
+		id, err := args.Int("<rollout_id>")
+		rollout, err := c.PauseRollout(ctx, &pb.PauseRolloutRequest{Id: int32(id)})
+		if Verify(err) {
+			printRollout(rollout)
+		}
+	} else if Match(args, "rollout resume <rollout_id>") {
+		id, err := args.Int("<rollout_id>")
+		rollout, err := c.ResumeRollout(ctx, &pb.ResumeRolloutRequest{Id: int32(id)})
+		if Verify(err) {
+			printRollout(rollout)
+		}
+	} else if Match(args, "rollout abort <rollout_id>") {
+		id, err := args.Int("<rollout_id>")
+		rollout, err := c.AbortRollout(ctx, &pb.AbortRolloutRequest{Id: int32(id)})
+		if Verify(err) {
+			printRollout(rollout)
+		}
+	} else if Match(args, "connect kiosk <kiosk_id>") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		err = connect(ctx, c, int32(kiosk_id))
+		Verify(err)
+	} else if Match(args, "kiosk <kiosk_id> command") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		command := &pb.KioskCommand{KioskId: int32(kiosk_id)}
+		for _, name := range []string{"refresh", "clear-cache", "identify", "restart-app", "reboot", "screenshot"} {
+			if Match(args, name) {
+				value := strings.ToUpper(strings.Replace(name, "-", "_", -1))
+				command.Type = pb.KioskCommand_Type(pb.KioskCommand_Type_value[value])
+			}
+		}
+		command, err = c.SendKioskCommand(ctx, command)
+		if Verify(err) {
+			fmt.Printf("%+v\n", command)
+		}
+	} else if Match(args, "kiosk <kiosk_id> commands") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		response, err := c.ListKioskCommands(ctx, &pb.ListKioskCommandsRequest{KioskId: int32(kiosk_id)})
+		if Verify(err) {
+			for _, command := range response.Commands {
+				fmt.Printf("%+v\n", command)
+			}
+		}
+	} else if Match(args, "list screenshots for kiosk <kiosk_id>") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		response, err := c.ListScreenshots(ctx, &pb.ListScreenshotsRequest{KioskId: int32(kiosk_id)})
+		if Verify(err) {
+			for _, screenshot := range response.Screenshots {
+				fmt.Printf("%+v\n", screenshot)
+			}
+		}
+	} else if Match(args, "get screenshot for kiosk <kiosk_id>") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		request := &pb.GetScreenshotRequest{KioskId: int32(kiosk_id)}
+		if id, err := args.Int("--id"); err == nil {
+			request.Id = int32(id)
+		}
+		screenshot, err := c.GetScreenshot(ctx, request)
+		if !Verify(err) {
+			return
+		}
+		if output, err := args.String("--output"); err == nil {
+			if !Verify(ioutil.WriteFile(output, screenshot.Image, 0644)) {
+				return
+			}
+		}
+		if len(screenshot.Image) > 16 {
+			screenshot.Image = screenshot.Image[0:16]
+		}
+		fmt.Printf("%+v\n", screenshot)
+	} else if Match(args, "upload screenshot for kiosk <kiosk_id>") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		request := &pb.Screenshot{KioskId: int32(kiosk_id)}
+		if filename, err := args.String("--image"); err == nil {
+			request.Image, err = ioutil.ReadFile(filename)
+			if !Verify(err) {
+				return
+			}
+		}
+		if command_id, err := args.Int("--command"); err == nil {
+			request.CommandId = int32(command_id)
+		}
+		screenshot, err := c.UploadScreenshot(ctx, request)
+		if Verify(err) {
+			fmt.Printf("%+v\n", screenshot)
+		}
+	} else if Match(args, "report kiosk <kiosk_id> showing sign <sign_id>") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		sign_id, err := args.Int("<sign_id>")
+		request := &pb.ReportKioskStatusRequest{
+			KioskId:         int32(kiosk_id),
+			DisplayedSignId: int32(sign_id),
+		}
+		if revision_id, err := args.Int("--revision"); err == nil {
+			request.DisplayedRevisionId = int32(revision_id)
+		}
+		err = c.ReportKioskStatus(ctx, request)
+		if Verify(err) {
+			fmt.Printf("Reported kiosk %d showing sign %d\n", kiosk_id, sign_id)
+		}
+	} else if Match(args, "report kiosk <kiosk_id> played sign <sign_id>") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		sign_id, err := args.Int("<sign_id>")
+		event := &pb.PlayEvent{SignId: int32(sign_id), EventId: newRequestID()}
+		if revision_id, err := args.Int("--revision"); err == nil {
+			event.RevisionId = int32(revision_id)
+		}
+		duration := time.Duration(0)
+		if value, err := args.String("--duration"); err == nil {
+			if duration, err = time.ParseDuration(value); !Verify(err) {
+				return
+			}
+		}
+		// The play has just ended.
+		event.StartTime, _ = ptypes.TimestampProto(time.Now().Add(-duration))
+		event.Duration = ptypes.DurationProto(duration)
+		err = c.ReportPlays(ctx, &pb.ReportPlaysRequest{
+			KioskId: int32(kiosk_id),
+			Events:  []*pb.PlayEvent{event},
+		})
+		if Verify(err) {
+			fmt.Printf("Reported kiosk %d playing sign %d\n", kiosk_id, sign_id)
+		}
+	} else if Match(args, "plays") {
+		request := &pb.QueryPlayReportsRequest{}
+		if sign_id, err := args.Int("--sign"); err == nil {
+			request.SignId = int32(sign_id)
+		}
+		if kiosk_id, err := args.Int("--kiosk"); err == nil {
+			request.KioskId = int32(kiosk_id)
+		}
+		if since, err := args.String("--since"); err == nil {
+			t, err := parseTime(since)
+			if !Verify(err) {
+				return
+			}
+			request.StartDate = dateOf(t)
+		}
+		if until, err := args.String("--until"); err == nil {
+			t, err := parseTime(until)
+			if !Verify(err) {
+				return
+			}
+			request.EndDate = dateOf(t)
+		}
+		response, err := c.QueryPlayReports(ctx, request)
+		if !Verify(err) {
+			return
+		}
+		if output, err := args.String("--output"); err == nil {
+			if Verify(writePlayReports(output, response.Reports)) {
+				fmt.Printf("Wrote %d reports to %s\n", len(response.Reports), output)
+			}
+			return
+		}
+		for _, record := range playRecords(response.Reports) {
+			fmt.Println(strings.Join(record, "\t"))
+		}
+	} else if Match(args, "audit") {
+		request := &pb.ListAuditEventsRequest{}
+		if resource, err := args.String("--resource"); err == nil {
+			request.Resource = resource
+		}
+		if principal, err := args.String("--principal"); err == nil {
+			request.Principal = principal
+		}
+		if since, err := args.String("--since"); err == nil {
+			request.StartTime, err = parseTime(since)
+			if !Verify(err) {
+				return
+			}
+		}
+		if until, err := args.String("--until"); err == nil {
+			request.EndTime, err = parseTime(until)
+			if !Verify(err) {
+				return
+			}
+		}
+		if limit, err := args.Int("--limit"); err == nil {
+			request.PageSize = int32(limit)
+		}
+		response, err := c.ListAuditEvents(ctx, request)
+		if Verify(err) {
+			for _, e := range response.Events {
+				t, _ := ptypes.Timestamp(e.Time)
+				fmt.Printf("%d %s %s %s %s\n", e.Id, t.Format(time.RFC3339), e.Principal, e.Method, e.Resource)
+			}
+		}
+	} else if Match(args, "create kiosks <file>") {
+		kiosks, err := readKiosks(args["<file>"].(string))
+		if !Verify(err) {
+			return
+		}
+		allOrNothing, _ := args.Bool("--all-or-nothing")
+		response, err := c.BatchCreateKiosks(ctx, &pb.BatchCreateKiosksRequest{
+			Kiosks:       kiosks,
+			AllOrNothing: allOrNothing,
+		})
+		if Verify(err) {
+			printStatuses(response.Statuses, func(i int) string {
+				return fmt.Sprintf("%+v", response.Kiosks[i])
+			})
+		}
+	} else if Match(args, "delete kiosks <file>") {
+		ids, err := readIds(args["<file>"].(string))
+		if !Verify(err) {
+			return
+		}
+		allOrNothing, _ := args.Bool("--all-or-nothing")
+		response, err := c.BatchDeleteKiosks(ctx, &pb.BatchDeleteKiosksRequest{
+			Ids:          ids,
+			AllOrNothing: allOrNothing,
+		})
+		if Verify(err) {
+			printStatuses(response.Statuses, func(i int) string {
+				return fmt.Sprintf("deleted kiosk %d", ids[i])
+			})
+		}
+	} else if Match(args, "create signs <file>") {
+		signs, err := readSigns(args["<file>"].(string))
+		if !Verify(err) {
+			return
+		}
+		allOrNothing, _ := args.Bool("--all-or-nothing")
+		response, err := c.BatchCreateSigns(ctx, &pb.BatchCreateSignsRequest{
+			Signs:        signs,
+			AllOrNothing: allOrNothing,
+		})
+		if Verify(err) {
+			printStatuses(response.Statuses, func(i int) string {
+				truncate(response.Signs[i])
+				return fmt.Sprintf("%+v", response.Signs[i])
+			})
+		}
+	} else if Match(args, "delete signs <file>") {
+		ids, err := readIds(args["<file>"].(string))
+		if !Verify(err) {
+			return
+		}
+		allOrNothing, _ := args.Bool("--all-or-nothing")
+		response, err := c.BatchDeleteSigns(ctx, &pb.BatchDeleteSignsRequest{
+			Ids:          ids,
+			AllOrNothing: allOrNothing,
+		})
+		if Verify(err) {
+			printStatuses(response.Statuses, func(i int) string {
+				return fmt.Sprintf("deleted sign %d", ids[i])
+			})
+		}
 	} else if Match(args, "create kiosk <name>") {
 		kiosk := &pb.Kiosk{
-			Name: args["<name>"].(string),
+			Name:      args["<name>"].(string),
+			RequestId: requestID(args),
 		}
 		newkiosk, err := c.CreateKiosk(ctx, kiosk)
 		if Verify(err) {
 			fmt.Printf("%+v\n", newkiosk)
 		}
 	} else if Match(args, "list kiosks") {
-		response, err := c.ListKiosks(ctx, &empty.Empty{})
+		showDeleted, _ := args.Bool("--show-deleted")
+		request := &pb.ListKiosksRequest{ShowDeleted: showDeleted}
+		if value, err := args.String("--offline-since"); err == nil {
+			offlineSince, err := time.ParseDuration(value)
+			if !Verify(err) {
+				return
+			}
+			request.OfflineSince = ptypes.DurationProto(offlineSince)
+		}
+		response, err := c.ListKiosks(ctx, request)
 		if Verify(err) {
 			for _, kiosk := range response.Kiosks {
 				fmt.Printf("%+v\n", kiosk)
@@ -209,15 +736,55 @@ func main() {
 		if Verify(err) {
 			fmt.Printf("%+v\n", kiosk)
 		}
+	} else if Match(args, "update kiosk <kiosk_id>") {
+		// Read, modify and write the kiosk. The etag makes the write fail
+		// if the kiosk has changed since it was read.
+		id, err := args.Int("<kiosk_id>")
+		kiosk, err := c.GetKiosk(ctx, &pb.GetKioskRequest{Id: int32(id)})
+		if !Verify(err) {
+			return
+		}
+		if etag, err := args.String("--etag"); err == nil {
+			kiosk.Etag = etag
+		}
+		if name, err := args.String("--name"); err == nil {
+			kiosk.Name = name
+		}
+		variables, err := parseVariables(args)
+		if !Verify(err) {
+			return
+		}
+		for name, value := range variables {
+			if kiosk.Variables == nil {
+				kiosk.Variables = make(map[string]string)
+			}
+			if value == "" {
+				delete(kiosk.Variables, name)
+			} else {
+				kiosk.Variables[name] = value
+			}
+		}
+		kiosk, err = c.UpdateKiosk(ctx, kiosk)
+		if Verify(err) {
+			fmt.Printf("%+v\n", kiosk)
+		}
 	} else if Match(args, "delete kiosk <kiosk_id>") {
 		id, err := args.Int("<kiosk_id>")
-		err = c.DeleteKiosk(ctx, &pb.DeleteKioskRequest{Id: int32(id)})
+		etag, _ := args.String("--etag")
+		err = c.DeleteKiosk(ctx, &pb.DeleteKioskRequest{Id: int32(id), Etag: etag})
 		if Verify(err) {
 			fmt.Printf("deleted\n")
 		}
+	} else if Match(args, "undelete kiosk <kiosk_id>") {
+		id, err := args.Int("<kiosk_id>")
+		kiosk, err := c.UndeleteKiosk(ctx, &pb.UndeleteKioskRequest{Id: int32(id)})
+		if Verify(err) {
+			fmt.Printf("%+v\n", kiosk)
+		}
 	} else if Match(args, "create sign") {
 		sign := &pb.Sign{
-			Name: args["<name>"].(string),
+			Name:      args["<name>"].(string),
+			RequestId: requestID(args),
 		}
 		text, has_text := args.String("--text")
 		if has_text == nil {
@@ -232,13 +799,175 @@ func main() {
 				return
 			}
 		}
+		if template_id, err := args.Int("--template"); err == nil {
+			sign.TemplateId = int32(template_id)
+		}
 		newsign, err := c.CreateSign(ctx, sign)
 		if Verify(err) {
 			truncate(newsign)
 			fmt.Printf("%+v\n", newsign)
 		}
+	} else if Match(args, "create template <name>") {
+		template := &pb.SignTemplate{Name: args["<name>"].(string)}
+		template.Text, _ = args.String("--text")
+		if image_name, err := args.String("--image"); err == nil {
+			template.Image, err = ioutil.ReadFile(image_name)
+			if !Verify(err) {
+				return
+			}
+		}
+		if template.Overlays, err = parseOverlays(args); !Verify(err) {
+			return
+		}
+		template, err = c.CreateSignTemplate(ctx, template)
+		if Verify(err) {
+			printTemplate(template)
+		}
+	} else if Match(args, "list templates") {
+		response, err := c.ListSignTemplates(ctx, &empty.Empty{})
+		if Verify(err) {
+			for _, template := range response.Templates {
+				printTemplate(template)
+			}
+		}
+	} else if Match(args, "get template <template_id>") {
+		id, err := args.Int("<template_id>")
+		template, err := c.GetSignTemplate(ctx, &pb.GetSignTemplateRequest{Id: int32(id)})
+		if Verify(err) {
+			printTemplate(template)
+		}
+	} else if Match(args, "update template <template_id>") {
+		id, err := args.Int("<template_id>")
+		template, err := c.GetSignTemplate(ctx, &pb.GetSignTemplateRequest{Id: int32(id)})
+		if !Verify(err) {
+			return
+		}
+		if etag, err := args.String("--etag"); err == nil {
+			template.Etag = etag
+		}
+		if name, err := args.String("--name"); err == nil {
+			template.Name = name
+		}
+		if text, err := args.String("--text"); err == nil {
+			template.Text = text
+		}
+		if image_name, err := args.String("--image"); err == nil {
+			template.Image, err = ioutil.ReadFile(image_name)
+			if !Verify(err) {
+				return
+			}
+		}
+		overlays, err := parseOverlays(args)
+		if !Verify(err) {
+			return
+		}
+		if len(overlays) > 0 {
+			template.Overlays = overlays
+		}
+		template, err = c.UpdateSignTemplate(ctx, template)
+		if Verify(err) {
+			printTemplate(template)
+		}
+	} else if Match(args, "delete template <template_id>") {
+		id, err := args.Int("<template_id>")
+		etag, _ := args.String("--etag")
+		err = c.DeleteSignTemplate(ctx, &pb.DeleteSignTemplateRequest{Id: int32(id), Etag: etag})
+		if Verify(err) {
+			fmt.Printf("deleted\n")
+		}
+	} else if Match(args, "create layout <name>") {
+		layout := &pb.Layout{Name: args["<name>"].(string)}
+		if layout.Regions, err = parseRegions(args); !Verify(err) {
+			return
+		}
+		layout, err = c.CreateLayout(ctx, layout)
+		if Verify(err) {
+			fmt.Printf("%+v\n", layout)
+		}
+	} else if Match(args, "list layouts") {
+		response, err := c.ListLayouts(ctx, &empty.Empty{})
+		if Verify(err) {
+			for _, layout := range response.Layouts {
+				fmt.Printf("%+v\n", layout)
+			}
+		}
+	} else if Match(args, "get layout for kiosk <kiosk_id>") {
+		kiosk_id, err := args.Int("<kiosk_id>")
+		response, err := c.GetKioskLayout(ctx, &pb.GetKioskLayoutRequest{KioskId: int32(kiosk_id)})
+		if Verify(err) {
+			fmt.Printf("%+v\n", response)
+		}
+	} else if Match(args, "get layout <layout_id>") {
+		id, err := args.Int("<layout_id>")
+		layout, err := c.GetLayout(ctx, &pb.GetLayoutRequest{Id: int32(id)})
+		if Verify(err) {
+			fmt.Printf("%+v\n", layout)
+		}
+	} else if Match(args, "delete layout <layout_id>") {
+		id, err := args.Int("<layout_id>")
+		err = c.DeleteLayout(ctx, &pb.DeleteLayoutRequest{Id: int32(id)})
+		if Verify(err) {
+			fmt.Printf("deleted\n")
+		}
+	} else if Match(args, "set layout <layout_id> for kiosk <kiosk_id>") {
+		id, err := args.Int("<layout_id>")
+		kiosk_id, err := args.Int("<kiosk_id>")
+		signIDs, err := parseRegionSigns(args)
+		if !Verify(err) {
+			return
+		}
+		response, err := c.SetKioskLayout(ctx, &pb.KioskLayout{
+			KioskId:  int32(kiosk_id),
+			LayoutId: int32(id),
+			SignIds:  signIDs,
+		})
+		if Verify(err) {
+			fmt.Printf("%+v\n", response)
+		}
+	} else if Match(args, "list sign revisions <sign_id>") {
+		id, err := args.Int("<sign_id>")
+		response, err := c.ListSignRevisions(ctx, &pb.ListSignRevisionsRequest{SignId: int32(id)})
+		if Verify(err) {
+			for _, r := range response.Revisions {
+				t, _ := ptypes.Timestamp(r.CreateTime)
+				fmt.Printf("%d %s %s %q %s\n", r.RevisionId, t.Format(time.RFC3339), r.Author, r.Text, r.ImageHash)
+			}
+		}
+	} else if Match(args, "get sign revision <sign_id> <revision_id>") {
+		id, err := args.Int("<sign_id>")
+		revision_id, err := args.Int("<revision_id>")
+		revision, err := c.GetSignRevision(ctx, &pb.GetSignRevisionRequest{
+			SignId:     int32(id),
+			RevisionId: int32(revision_id),
+		})
+		if !Verify(err) {
+			return
+		}
+		if output, err := args.String("--output"); err == nil {
+			if !Verify(ioutil.WriteFile(output, revision.Image, 0644)) {
+				return
+			}
+		}
+		if len(revision.Image) > 16 {
+			revision.Image = revision.Image[0:16]
+		}
+		fmt.Printf("%+v\n", revision)
+	} else if Match(args, "rollback sign <sign_id> to <revision_id>") {
+		id, err := args.Int("<sign_id>")
+		revision_id, err := args.Int("<revision_id>")
+		etag, _ := args.String("--etag")
+		sign, err := c.RollbackSign(ctx, &pb.RollbackSignRequest{
+			SignId:     int32(id),
+			RevisionId: int32(revision_id),
+			Etag:       etag,
+		})
+		if Verify(err) {
+			truncate(sign)
+			fmt.Printf("%+v\n", sign)
+		}
 	} else if Match(args, "list signs") {
-		response, err := c.ListSigns(ctx, &empty.Empty{})
+		showDeleted, _ := args.Bool("--show-deleted")
+		response, err := c.ListSigns(ctx, &pb.ListSignsRequest{ShowDeleted: showDeleted})
 		if Verify(err) {
 			for _, sign := range response.Signs {
 				truncate(sign)
@@ -252,11 +981,52 @@ func main() {
 			truncate(sign)
 			fmt.Printf("%+v\n", sign)
 		}
+	} else if Match(args, "update sign") {
+		id, err := args.Int("<sign_id>")
+		sign, err := c.GetSign(ctx, &pb.GetSignRequest{Id: int32(id)})
+		if !Verify(err) {
+			return
+		}
+		if etag, err := args.String("--etag"); err == nil {
+			sign.Etag = etag
+		}
+		if name, err := args.String("--name"); err == nil {
+			sign.Name = name
+		}
+		if text, err := args.String("--text"); err == nil {
+			sign.Text = text
+		}
+		if image_name, err := args.String("--image"); err == nil {
+			sign.Image, err = ioutil.ReadFile(image_name)
+			if !Verify(err) {
+				return
+			}
+		}
+		if template_id, err := args.Int("--template"); err == nil {
+			// A sign made from a template has no content of its own.
+			sign.TemplateId = int32(template_id)
+			if template_id != 0 {
+				sign.Text, sign.Image = "", nil
+			}
+		}
+		sign, err = c.UpdateSign(ctx, sign)
+		if Verify(err) {
+			truncate(sign)
+			fmt.Printf("%+v\n", sign)
+		}
 	} else if Match(args, "delete sign") {
 		id, err := args.Int("<sign_id>")
-		err = c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: int32(id)})
+		etag, _ := args.String("--etag")
+		err = c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: int32(id), Etag: etag})
 		if Verify(err) {
 			fmt.Printf("deleted\n")
 		}
+	} else if Match(args, "undelete sign") {
+		id, err := args.Int("<sign_id>")
+		sign, err := c.UndeleteSign(ctx, &pb.UndeleteSignRequest{Id: int32(id)})
+		if Verify(err) {
+			truncate(sign)
+			fmt.Printf("%+v\n", sign)
+		}
 	}
 }
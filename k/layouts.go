@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docopt/docopt-go"
+	pb "github.com/googleapis/kiosk/generated"
+)
+
+// parseRegions parses the --region options, which are like
+// "ticker,0,0.9,1,0.1" for a region named ticker along the bottom tenth of
+// the screen.
+func parseRegions(args docopt.Opts) ([]*pb.Layout_Region, error) {
+	values, _ := args["--region"].([]string)
+	regions := []*pb.Layout_Region{}
+	for _, value := range values {
+		parts := strings.Split(value, ",")
+		if len(parts) != 5 {
+			return nil, fmt.Errorf("invalid region %q, expected name,x,y,width,height", value)
+		}
+		numbers := make([]float32, 4)
+		for i, part := range parts[1:] {
+			number, err := strconv.ParseFloat(part, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid region %q: %v", value, err)
+			}
+			numbers[i] = float32(number)
+		}
+		regions = append(regions, &pb.Layout_Region{
+			Name:   parts[0],
+			X:      numbers[0],
+			Y:      numbers[1],
+			Width:  numbers[2],
+			Height: numbers[3],
+		})
+	}
+	return regions, nil
+}
+
+// parseRegionSigns parses the --region-sign options, which are like
+// "ticker=3" for sign 3 in the region named ticker.
+func parseRegionSigns(args docopt.Opts) (map[string]int32, error) {
+	values, _ := args["--region-sign"].([]string)
+	signIDs := make(map[string]int32)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid region sign %q, expected region=sign_id", value)
+		}
+		signID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid region sign %q: %v", value, err)
+		}
+		signIDs[parts[0]] = int32(signID)
+	}
+	return signIDs, nil
+}
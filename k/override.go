@@ -0,0 +1,64 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/googleapis/kiosk/generated"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// parseRegion parses a center like "40.7,-74.0" and a radius in meters.
+func parseRegion(near string, radius string) (*pb.Override_Region, error) {
+	parts := strings.Split(near, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid location %q", near)
+	}
+	latitude, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latitude %q", parts[0])
+	}
+	longitude, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid longitude %q", parts[1])
+	}
+	meters, err := strconv.ParseFloat(radius, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid radius %q", radius)
+	}
+	return &pb.Override_Region{
+		Center:       &latlng.LatLng{Latitude: latitude, Longitude: longitude},
+		RadiusMeters: meters,
+	}, nil
+}
+
+// printOverride prints a summary of an emergency override.
+func printOverride(o *pb.Override) {
+	fmt.Printf("override %d: sign %d", o.Id, o.SignId)
+	if o.RevisionId != 0 {
+		fmt.Printf(" revision %d", o.RevisionId)
+	}
+	fmt.Printf(" %s on kiosks %v by %s", o.State, o.KioskIds, o.Creator)
+	if o.Reason != "" {
+		fmt.Printf(" (%s)", o.Reason)
+	}
+	if o.State == pb.Override_CLEARED {
+		fmt.Printf(", cleared by %s", o.Clearer)
+	}
+	fmt.Printf("\n")
+}
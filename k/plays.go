@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	pb "github.com/googleapis/kiosk/generated"
+	"google.golang.org/genproto/googleapis/type/date"
+)
+
+// dateOf returns the UTC date of a time.
+func dateOf(ts *timestamp.Timestamp) *date.Date {
+	t, _ := ptypes.Timestamp(ts)
+	return &date.Date{Year: int32(t.Year()), Month: int32(t.Month()), Day: int32(t.Day())}
+}
+
+// formatDate formats a date as YYYY-MM-DD.
+func formatDate(d *date.Date) string {
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+// playRecords returns play reports as rows of a table with a header row.
+func playRecords(reports []*pb.PlayReport) [][]string {
+	records := [][]string{{"date", "sign_id", "kiosk_id", "impressions", "on_screen_seconds"}}
+	for _, report := range reports {
+		onScreen, _ := ptypes.Duration(report.OnScreenTime)
+		records = append(records, []string{
+			formatDate(report.Date),
+			strconv.Itoa(int(report.SignId)),
+			strconv.Itoa(int(report.KioskId)),
+			strconv.FormatInt(report.Impressions, 10),
+			strconv.FormatFloat(onScreen.Seconds(), 'f', -1, 64),
+		})
+	}
+	return records
+}
+
+// writePlayReports writes play reports to a CSV file.
+func writePlayReports(path string, reports []*pb.PlayReport) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.WriteAll(playRecords(reports))
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	pb "github.com/googleapis/kiosk/generated"
+)
+
+// parseStages parses stages like "5:1h,25,100", which are percentages of
+// kiosks with an optional wait before the next stage. Stages without a wait
+// need approval.
+func parseStages(value string) ([]*pb.Rollout_Stage, error) {
+	stages := []*pb.Rollout_Stage{}
+	for _, field := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), ":", 2)
+		percent, err := strconv.Atoi(strings.TrimSuffix(parts[0], "%"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid stage %q", field)
+		}
+		stage := &pb.Rollout_Stage{Percent: int32(percent)}
+		if len(parts) == 2 {
+			wait, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid stage %q: %v", field, err)
+			}
+			stage.Wait = ptypes.DurationProto(wait)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// parseKioskIds parses a comma-separated list of kiosk ids.
+func parseKioskIds(value string) ([]int32, error) {
+	ids := []int32{}
+	for _, field := range strings.Split(value, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid kiosk id %q", field)
+		}
+		ids = append(ids, int32(id))
+	}
+	return ids, nil
+}
+
+// printRollout prints the progress of a rollout.
+func printRollout(r *pb.Rollout) {
+	sign := fmt.Sprintf("sign %d", r.SignId)
+	if r.RevisionId != 0 {
+		sign += fmt.Sprintf(" revision %d", r.RevisionId)
+	}
+	fmt.Printf("rollout %d: %s %s, stage %d of %d (%d%%), %d of %d kiosks updated",
+		r.Id, sign, r.State, r.CurrentStage+1, len(r.Stages),
+		r.Stages[r.CurrentStage].Percent, r.UpdatedKioskCount, len(r.KioskIds))
+	if r.NextStageTime != nil {
+		t, _ := ptypes.Timestamp(r.NextStageTime)
+		fmt.Printf(", next stage at %s", t.Local().Format(time.RFC3339))
+	}
+	fmt.Printf("\n")
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/googleapis/kiosk/gapic"
+	pb "github.com/googleapis/kiosk/generated"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+// connect acts as a kiosk in a session with the server. It prints what the
+// server sends, reports every sign that it is sent as displayed and every
+// command as successful, and sends heartbeats as often as the server asks.
+// It has no screen, so it reports screenshot commands as unimplemented.
+func connect(ctx context.Context, c *gapic.DisplayClient, kioskID int32) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	session, err := c.KioskSession(ctx)
+	if err != nil {
+		return err
+	}
+	var mux sync.Mutex // streams can't be sent to concurrently
+	send := func(m *pb.KioskSessionRequest) error {
+		mux.Lock()
+		defer mux.Unlock()
+		return session.Send(m)
+	}
+	err = send(&pb.KioskSessionRequest{
+		Message: &pb.KioskSessionRequest_Hello{Hello: &pb.KioskHello{KioskId: kioskID, IncludeRegions: true}},
+	})
+	if err != nil {
+		return err
+	}
+	intervals := make(chan time.Duration, 1)
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case interval := <-intervals:
+				ticker.Reset(interval)
+			case <-ticker.C:
+				send(&pb.KioskSessionRequest{
+					Message: &pb.KioskSessionRequest_Heartbeat{Heartbeat: &empty.Empty{}},
+				})
+			}
+		}
+	}()
+	for {
+		m, err := session.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch m := m.Message.(type) {
+		case *pb.KioskSessionResponse_Config:
+			fmt.Printf("config: %+v\n", m.Config)
+			if interval, err := ptypes.Duration(m.Config.HeartbeatInterval); err == nil && interval > 0 {
+				select {
+				case intervals <- interval:
+				default:
+				}
+			}
+		case *pb.KioskSessionResponse_Assignment:
+			fmt.Printf("assignment: %+v\n", m.Assignment)
+			if m.Assignment.Region != "" {
+				// Status reports only the kiosk's own sign.
+				break
+			}
+			err := send(&pb.KioskSessionRequest{
+				Message: &pb.KioskSessionRequest_Status{Status: &pb.ReportKioskStatusRequest{
+					DisplayedSignId:     m.Assignment.SignId,
+					DisplayedRevisionId: m.Assignment.RevisionId,
+				}},
+			})
+			if err != nil {
+				return err
+			}
+		case *pb.KioskSessionResponse_Prefetch:
+			fmt.Printf("prefetch: %+v\n", m.Prefetch)
+		case *pb.KioskSessionResponse_Command:
+			fmt.Printf("command: %+v\n", m.Command)
+			result := &status.Status{}
+			if m.Command.Type == pb.KioskCommand_SCREENSHOT {
+				result = &status.Status{Code: int32(codes.Unimplemented), Message: "k can't take screenshots"}
+			}
+			err := send(&pb.KioskSessionRequest{
+				Message: &pb.KioskSessionRequest_CommandResult{CommandResult: &pb.ReportCommandResultRequest{
+					CommandId: m.Command.Id,
+					Result:    result,
+				}},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docopt/docopt-go"
+	pb "github.com/googleapis/kiosk/generated"
+)
+
+// parseVariables parses the --var options, which are like "price=3.99".
+func parseVariables(args docopt.Opts) (map[string]string, error) {
+	values, _ := args["--var"].([]string)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	variables := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid variable %q, expected name=value", value)
+		}
+		variables[parts[0]] = parts[1]
+	}
+	return variables, nil
+}
+
+// parseOverlays parses the --overlay options, which are like "0.1,0.9,text"
+// for text whose top left corner is 10% across and 90% down the screen.
+func parseOverlays(args docopt.Opts) ([]*pb.TextOverlay, error) {
+	values, _ := args["--overlay"].([]string)
+	overlays := []*pb.TextOverlay{}
+	for _, value := range values {
+		parts := strings.SplitN(value, ",", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid overlay %q, expected x,y,text", value)
+		}
+		x, err := strconv.ParseFloat(parts[0], 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid overlay %q: %v", value, err)
+		}
+		y, err := strconv.ParseFloat(parts[1], 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid overlay %q: %v", value, err)
+		}
+		overlays = append(overlays, &pb.TextOverlay{X: float32(x), Y: float32(y), Text: parts[2]})
+	}
+	return overlays, nil
+}
+
+// printTemplate prints a sign template without its image.
+func printTemplate(template *pb.SignTemplate) {
+	template.Image = nil
+	fmt.Printf("%+v\n", template)
+}
@@ -17,15 +17,29 @@
 package test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes"
 	pb "github.com/googleapis/kiosk/generated"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func address() string {
@@ -42,6 +56,19 @@ func address() string {
 	return address
 }
 
+// httpAddress returns the URL of the server's REST gateway.
+func httpAddress() string {
+	host := os.Getenv("KIOSK_SERVER")
+	if host == "" {
+		host = "localhost"
+	}
+	port := os.Getenv("KIOSK_HTTP_PORT")
+	if port == "" {
+		port = "8081"
+	}
+	return "http://" + host + ":" + port
+}
+
 func assertNoError(t *testing.T, err error) {
 	if err != nil {
 		t.Fatalf("%v", err)
@@ -56,7 +83,8 @@ func assertEqual(t *testing.T, a interface{}, b interface{}) {
 
 func TestKiosk(t *testing.T) {
 	// Create a connection to the server.
-	ctx, _ := context.WithTimeout(context.TODO(), 1*time.Second)
+	ctx, cancel := context.WithTimeout(context.TODO(), 1*time.Second)
+	defer cancel()
 	conn, err := grpc.DialContext(ctx, address(), grpc.WithInsecure(), grpc.WithBlock())
 	assertNoError(t, err)
 	defer conn.Close()
@@ -66,7 +94,7 @@ func TestKiosk(t *testing.T) {
 
 	// Delete all kiosks.
 	{
-		response, err := c.ListKiosks(ctx, &empty.Empty{})
+		response, err := c.ListKiosks(ctx, &pb.ListKiosksRequest{})
 		assertNoError(t, err)
 		for _, k := range response.Kiosks {
 			_, err := c.DeleteKiosk(ctx, &pb.DeleteKioskRequest{Id: int32(k.Id)})
@@ -75,13 +103,13 @@ func TestKiosk(t *testing.T) {
 	}
 	// List all kiosks and verify that the count is zero.
 	{
-		response, err := c.ListKiosks(ctx, &empty.Empty{})
+		response, err := c.ListKiosks(ctx, &pb.ListKiosksRequest{})
 		assertNoError(t, err)
 		assertEqual(t, len(response.Kiosks), 0)
 	}
 	// Delete all signs.
 	{
-		response, err := c.ListSigns(ctx, &empty.Empty{})
+		response, err := c.ListSigns(ctx, &pb.ListSignsRequest{})
 		assertNoError(t, err)
 		for _, s := range response.Signs {
 			_, err := c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: int32(s.Id)})
@@ -90,7 +118,7 @@ func TestKiosk(t *testing.T) {
 	}
 	// List all signs and verify that the count is zero.
 	{
-		response, err := c.ListSigns(ctx, &empty.Empty{})
+		response, err := c.ListSigns(ctx, &pb.ListSignsRequest{})
 		assertNoError(t, err)
 		assertEqual(t, len(response.Signs), 0)
 	}
@@ -126,13 +154,13 @@ func TestKiosk(t *testing.T) {
 	}
 	// List all kiosks and verify the count.
 	{
-		response, err := c.ListKiosks(ctx, &empty.Empty{})
+		response, err := c.ListKiosks(ctx, &pb.ListKiosksRequest{})
 		assertNoError(t, err)
 		assertEqual(t, len(response.Kiosks), 1)
 	}
 	// List all signs and verify the count.
 	{
-		response, err := c.ListSigns(ctx, &empty.Empty{})
+		response, err := c.ListSigns(ctx, &pb.ListSignsRequest{})
 		assertNoError(t, err)
 		assertEqual(t, len(response.Signs), 2)
 	}
@@ -168,9 +196,893 @@ func TestKiosk(t *testing.T) {
 		assertNoError(t, err)
 		assertEqual(t, response.SignId, sign2_id)
 	}
+	// Retry a sign creation and verify that it returns the same sign, until
+	// the sign is deleted.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		requestID := fmt.Sprintf("test-%d", time.Now().UnixNano())
+		sign, err := c.CreateSign(ctx, &pb.Sign{Name: "C", RequestId: requestID})
+		assertNoError(t, err)
+		retried, err := c.CreateSign(ctx, &pb.Sign{Name: "C", RequestId: requestID})
+		assertNoError(t, err)
+		assertEqual(t, retried.Id, sign.Id)
+		_, err = c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: sign.Id})
+		assertNoError(t, err)
+		recreated, err := c.CreateSign(ctx, &pb.Sign{Name: "C", RequestId: requestID})
+		assertNoError(t, err)
+		assertEqual(t, recreated.Id != sign.Id, true)
+		_, err = c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: recreated.Id})
+		assertNoError(t, err)
+	}
+	// Set the same sign again and verify that the kiosk is unchanged.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		response, err := c.SetSignIdForKioskIds(ctx, &pb.SetSignIdForKioskIdsRequest{
+			SignId:   int32(sign2_id),
+			KioskIds: []int32{int32(kiosk_id)},
+		})
+		assertNoError(t, err)
+		assertEqual(t, len(response.ChangedKioskIds), 0)
+		assertEqual(t, len(response.UnchangedKioskIds), 1)
+	}
+	// Set a sign for a valid and an invalid kiosk and verify that nothing changes.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := c.SetSignIdForKioskIds(ctx, &pb.SetSignIdForKioskIdsRequest{
+			SignId:   int32(sign1_id),
+			KioskIds: []int32{int32(kiosk_id), -1},
+		})
+		if err == nil {
+			t.Errorf("set a sign for an invalid kiosk id")
+		}
+		response, err := c.GetSignIdForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		assertEqual(t, response.SignId, sign2_id)
+	}
+	// Open a session and verify that it starts with the config and the sign.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		session, err := c.KioskSession(ctx)
+		assertNoError(t, err)
+		err = session.Send(&pb.KioskSessionRequest{
+			Message: &pb.KioskSessionRequest_Hello{Hello: &pb.KioskHello{KioskId: int32(kiosk_id)}},
+		})
+		assertNoError(t, err)
+		response, err := session.Recv()
+		assertNoError(t, err)
+		assertEqual(t, response.GetConfig().GetKiosk().GetId(), int32(kiosk_id))
+		response, err = session.Recv()
+		assertNoError(t, err)
+		assertEqual(t, response.GetAssignment().GetSignId(), sign2_id)
+		session.CloseSend()
+	}
+	// Report the displayed sign and verify that the kiosk is online.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := c.ReportKioskStatus(ctx, &pb.ReportKioskStatusRequest{
+			KioskId:         int32(kiosk_id),
+			DisplayedSignId: int32(sign2_id),
+		})
+		assertNoError(t, err)
+		kiosk, err := c.GetKiosk(ctx, &pb.GetKioskRequest{Id: int32(kiosk_id)})
+		assertNoError(t, err)
+		assertEqual(t, kiosk.ConnectionState, pb.Kiosk_ONLINE)
+		assertEqual(t, kiosk.DisplayedSignId, sign2_id)
+	}
+	// Watch a kiosk's signs, then drop the stream and verify that the kiosk
+	// is no longer connected.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		kiosk, err := c.CreateKiosk(ctx, &pb.Kiosk{Name: "unplugged"})
+		assertNoError(t, err)
+		streamCtx, drop := context.WithCancel(ctx)
+		stream, err := c.GetSignIdsForKioskId(streamCtx, &pb.GetSignIdForKioskIdRequest{KioskId: kiosk.Id})
+		assertNoError(t, err)
+		_, err = stream.Recv()
+		assertNoError(t, err)
+		kiosk, err = c.GetKiosk(ctx, &pb.GetKioskRequest{Id: kiosk.Id})
+		assertNoError(t, err)
+		assertEqual(t, kiosk.ConnectionState, pb.Kiosk_CONNECTED)
+		drop()
+		for kiosk.ConnectionState == pb.Kiosk_CONNECTED && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+			kiosk, err = c.GetKiosk(ctx, &pb.GetKioskRequest{Id: kiosk.Id})
+			assertNoError(t, err)
+		}
+		assertEqual(t, kiosk.ConnectionState, pb.Kiosk_ONLINE)
+		_, err = c.DeleteKiosk(ctx, &pb.DeleteKioskRequest{Id: kiosk.Id})
+		assertNoError(t, err)
+	}
+	// Report a play twice, as if retrying, and verify that it is counted once.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		request := &pb.ReportPlaysRequest{
+			KioskId: int32(kiosk_id),
+			Events: []*pb.PlayEvent{{
+				SignId:    int32(sign2_id),
+				StartTime: ptypes.TimestampNow(),
+				Duration:  ptypes.DurationProto(10 * time.Second),
+				EventId:   fmt.Sprintf("test-%d", time.Now().UnixNano()),
+			}},
+		}
+		_, err := c.ReportPlays(ctx, request)
+		assertNoError(t, err)
+		_, err = c.ReportPlays(ctx, request)
+		assertNoError(t, err)
+		response, err := c.QueryPlayReports(ctx, &pb.QueryPlayReportsRequest{
+			SignId:  int32(sign2_id),
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		if len(response.Reports) != 1 {
+			t.Errorf("expected 1 play report, got %d", len(response.Reports))
+		} else {
+			assertEqual(t, response.Reports[0].Impressions, int64(1))
+		}
+	}
+	// Send a command, report its result and verify that it succeeded.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		command, err := c.SendKioskCommand(ctx, &pb.KioskCommand{
+			KioskId: int32(kiosk_id),
+			Type:    pb.KioskCommand_REFRESH,
+		})
+		assertNoError(t, err)
+		assertEqual(t, command.State, pb.KioskCommand_QUEUED)
+		command, err = c.ReportCommandResult(ctx, &pb.ReportCommandResultRequest{
+			KioskId:   int32(kiosk_id),
+			CommandId: command.Id,
+		})
+		assertNoError(t, err)
+		assertEqual(t, command.State, pb.KioskCommand_SUCCEEDED)
+	}
+	// Ask for a screenshot and upload it.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		command, err := c.SendKioskCommand(ctx, &pb.KioskCommand{
+			KioskId: int32(kiosk_id),
+			Type:    pb.KioskCommand_SCREENSHOT,
+		})
+		assertNoError(t, err)
+		_, err = c.UploadScreenshot(ctx, &pb.Screenshot{
+			KioskId:   int32(kiosk_id),
+			Image:     []byte("screenshot"),
+			CommandId: command.Id,
+		})
+		assertNoError(t, err)
+		screenshot, err := c.GetScreenshot(ctx, &pb.GetScreenshotRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		assertEqual(t, string(screenshot.Image), "screenshot")
+		command, err = c.GetKioskCommand(ctx, &pb.GetKioskCommandRequest{
+			KioskId: int32(kiosk_id),
+			Id:      command.Id,
+		})
+		assertNoError(t, err)
+		assertEqual(t, command.State, pb.KioskCommand_SUCCEEDED)
+	}
+	// Override all kiosks, then clear the override and verify that the
+	// kiosk is restored. Kiosks that are created or undeleted while the
+	// override is active are overridden too.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		deleted, err := c.CreateKiosk(ctx, &pb.Kiosk{Name: "deleted"})
+		assertNoError(t, err)
+		_, err = c.DeleteKiosk(ctx, &pb.DeleteKioskRequest{Id: deleted.Id})
+		assertNoError(t, err)
+		override, err := c.EmergencyOverride(ctx, &pb.EmergencyOverrideRequest{
+			SignId: int32(sign1_id),
+			Reason: "test",
+		})
+		assertNoError(t, err)
+		assertEqual(t, override.State, pb.Override_ACTIVE)
+		response, err := c.GetSignIdForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		assertEqual(t, response.SignId, sign1_id)
+		created, err := c.CreateKiosk(ctx, &pb.Kiosk{Name: "created"})
+		assertNoError(t, err)
+		_, err = c.UndeleteKiosk(ctx, &pb.UndeleteKioskRequest{Id: deleted.Id})
+		assertNoError(t, err)
+		for _, id := range []int32{created.Id, deleted.Id} {
+			response, err := c.GetSignIdForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
+				KioskId: id,
+			})
+			assertNoError(t, err)
+			assertEqual(t, response.SignId, sign1_id)
+		}
+		_, err = c.ClearEmergencyOverride(ctx, &pb.ClearEmergencyOverrideRequest{Id: override.Id})
+		assertNoError(t, err)
+		response, err = c.GetSignIdForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		assertEqual(t, response.SignId, sign2_id)
+		for _, id := range []int32{created.Id, deleted.Id} {
+			response, err := c.GetSignIdForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
+				KioskId: id,
+			})
+			assertNoError(t, err)
+			assertEqual(t, response.SignId, int32(0))
+			_, err = c.DeleteKiosk(ctx, &pb.DeleteKioskRequest{Id: id})
+			assertNoError(t, err)
+		}
+	}
+	// Start a drill inside an evacuation, clear the drill and verify that
+	// the kiosk shows the evacuation until it is cleared too.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		drill, err := c.CreateSign(ctx, &pb.Sign{Name: "drill", Text: "Drill"})
+		assertNoError(t, err)
+		evacuation, err := c.EmergencyOverride(ctx, &pb.EmergencyOverrideRequest{
+			SignId: int32(sign1_id),
+			Reason: "evacuation",
+		})
+		assertNoError(t, err)
+		override, err := c.EmergencyOverride(ctx, &pb.EmergencyOverrideRequest{
+			SignId: drill.Id,
+			Reason: "drill",
+		})
+		assertNoError(t, err)
+		for _, step := range []struct {
+			id     int32
+			signID int32
+		}{{override.Id, sign1_id}, {evacuation.Id, sign2_id}} {
+			_, err = c.ClearEmergencyOverride(ctx, &pb.ClearEmergencyOverrideRequest{Id: step.id})
+			assertNoError(t, err)
+			response, err := c.GetSignIdForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
+				KioskId: int32(kiosk_id),
+			})
+			assertNoError(t, err)
+			assertEqual(t, response.SignId, step.signID)
+		}
+		_, err = c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: drill.Id})
+		assertNoError(t, err)
+	}
+	// Get the manifest of a kiosk, which starts with its current sign.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		manifest, err := c.GetKioskManifest(ctx, &pb.GetKioskManifestRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		if len(manifest.Entries) == 0 {
+			t.Errorf("expected a manifest entry for kiosk %d", kiosk_id)
+		} else {
+			assertEqual(t, manifest.Entries[0].SignId, sign2_id)
+			assertEqual(t, manifest.Entries[0].Reason, pb.ManifestEntry_ASSIGNED)
+		}
+	}
+	// Roll out a sign, then abort and verify that the kiosk is restored.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		rollout, err := c.CreateRollout(ctx, &pb.Rollout{
+			SignId:   int32(sign1_id),
+			KioskIds: []int32{int32(kiosk_id)},
+			Stages:   []*pb.Rollout_Stage{{Percent: 100}},
+		})
+		assertNoError(t, err)
+		assertEqual(t, rollout.State, pb.Rollout_SUCCEEDED)
+		_, err = c.AbortRollout(ctx, &pb.AbortRolloutRequest{Id: rollout.Id})
+		assertNoError(t, err)
+		response, err := c.GetSignIdForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		assertEqual(t, response.SignId, sign2_id)
+	}
+	// Make a sign from a template and verify that the kiosk's variables are
+	// filled in.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		template, err := c.CreateSignTemplate(ctx, &pb.SignTemplate{
+			Name: "prices",
+			Text: "Coffee {{price}}",
+		})
+		assertNoError(t, err)
+		sign, err := c.CreateSign(ctx, &pb.Sign{
+			Name:       "coffee",
+			TemplateId: template.Id,
+		})
+		assertNoError(t, err)
+		_, err = c.SetSignIdForKioskIds(ctx, &pb.SetSignIdForKioskIdsRequest{
+			KioskIds:  []int32{int32(kiosk_id)},
+			SignId:    sign.Id,
+			Variables: map[string]string{"price": "3.99"},
+		})
+		assertNoError(t, err)
+		effective, err := c.GetEffectiveSign(ctx, &pb.GetEffectiveSignRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		assertEqual(t, effective.Text, "Coffee 3.99")
+	}
+	// Make a sign that shows a value from the data feed, then change it.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		sign, err := c.CreateSign(ctx, &pb.Sign{
+			Name: "wait",
+			Text: "Wait: {{data.wait}} min",
+		})
+		assertNoError(t, err)
+		_, err = c.SetSignIdForKioskIds(ctx, &pb.SetSignIdForKioskIdsRequest{
+			KioskIds: []int32{int32(kiosk_id)},
+			SignId:   sign.Id,
+		})
+		assertNoError(t, err)
+		_, err = c.SetDataValue(ctx, &pb.DataValue{Key: "wait", Value: "15"})
+		assertNoError(t, err)
+		effective, err := c.GetEffectiveSign(ctx, &pb.GetEffectiveSignRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		assertEqual(t, effective.Text, "Wait: 15 min")
+		_, err = c.DeleteDataValue(ctx, &pb.DeleteDataValueRequest{Key: "wait"})
+		assertNoError(t, err)
+	}
+	// Show a value from the data feed through a template variable, then
+	// change it and verify that the kiosk is sent its assignment again with
+	// the same etag.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		template, err := c.CreateSignTemplate(ctx, &pb.SignTemplate{
+			Name: "queue",
+			Text: "Now serving {{counter}}",
+		})
+		assertNoError(t, err)
+		sign, err := c.CreateSign(ctx, &pb.Sign{
+			Name:       "queue",
+			TemplateId: template.Id,
+		})
+		assertNoError(t, err)
+		_, err = c.SetSignIdForKioskIds(ctx, &pb.SetSignIdForKioskIdsRequest{
+			KioskIds:  []int32{int32(kiosk_id)},
+			SignId:    sign.Id,
+			Variables: map[string]string{"counter": "{{data.queue}}"},
+		})
+		assertNoError(t, err)
+		before, err := c.GetSignIdForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		streamCtx, stop := context.WithCancel(ctx)
+		stream, err := c.GetSignIdsForKioskId(streamCtx, &pb.GetSignIdForKioskIdRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		_, err = stream.Recv()
+		assertNoError(t, err)
+		_, err = c.SetDataValue(ctx, &pb.DataValue{Key: "queue", Value: "42"})
+		assertNoError(t, err)
+		update, err := stream.Recv()
+		assertNoError(t, err)
+		stop()
+		assertEqual(t, update.SignId, sign.Id)
+		assertEqual(t, update.Etag, before.Etag)
+		after, err := c.GetSignIdForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		assertEqual(t, after.Etag, before.Etag)
+		effective, err := c.GetEffectiveSign(ctx, &pb.GetEffectiveSignRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		assertEqual(t, effective.Text, "Now serving 42")
+		_, err = c.DeleteDataValue(ctx, &pb.DeleteDataValueRequest{Key: "queue"})
+		assertNoError(t, err)
+	}
+	// Give the kiosk a layout with a sign in one of its regions, then remove
+	// it. Only streams that ask for regions receive their signs.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		layout, err := c.CreateLayout(ctx, &pb.Layout{
+			Name: "shop",
+			Regions: []*pb.Layout_Region{
+				{Name: "main", Width: 1, Height: 0.9},
+				{Name: "ticker", Y: 0.9, Width: 1, Height: 0.1},
+			},
+		})
+		assertNoError(t, err)
+		sign, err := c.CreateSign(ctx, &pb.Sign{
+			Name: "news",
+			Text: "News",
+		})
+		assertNoError(t, err)
+		streamCtx, stop := context.WithCancel(ctx)
+		plain, err := c.GetSignIdsForKioskId(streamCtx, &pb.GetSignIdForKioskIdRequest{
+			KioskId: int32(kiosk_id),
+		})
+		assertNoError(t, err)
+		_, err = plain.Recv()
+		assertNoError(t, err)
+		regions, err := c.GetSignIdsForKioskId(streamCtx, &pb.GetSignIdForKioskIdRequest{
+			KioskId:        int32(kiosk_id),
+			IncludeRegions: true,
+		})
+		assertNoError(t, err)
+		_, err = regions.Recv()
+		assertNoError(t, err)
+		_, err = c.SetKioskLayout(ctx, &pb.KioskLayout{
+			KioskId:  int32(kiosk_id),
+			LayoutId: layout.Id,
+			SignIds:  map[string]int32{"ticker": sign.Id},
+		})
+		assertNoError(t, err)
+		effective, err := c.GetEffectiveSign(ctx, &pb.GetEffectiveSignRequest{
+			KioskId: int32(kiosk_id),
+			Region:  "ticker",
+		})
+		assertNoError(t, err)
+		assertEqual(t, effective.Text, "News")
+		for _, region := range []string{"", "main", "ticker"} {
+			update, err := regions.Recv()
+			assertNoError(t, err)
+			assertEqual(t, update.Region, region)
+			assertEqual(t, update.LayoutId, layout.Id)
+		}
+		_, err = c.SetKioskLayout(ctx, &pb.KioskLayout{KioskId: int32(kiosk_id)})
+		assertNoError(t, err)
+		for _, layoutID := range []int32{layout.Id, 0} {
+			update, err := plain.Recv()
+			assertNoError(t, err)
+			assertEqual(t, update.Region, "")
+			assertEqual(t, update.LayoutId, layoutID)
+		}
+		stop()
+		_, err = c.DeleteLayout(ctx, &pb.DeleteLayoutRequest{Id: layout.Id})
+		assertNoError(t, err)
+	}
+	// Create a sign over the REST gateway and read it back.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		body := strings.NewReader(`{"name": "rest", "text": "Hello"}`)
+		response, err := http.Post(httpAddress()+"/v1/signs", "application/json", body)
+		assertNoError(t, err)
+		var sign struct {
+			Id   int32  `json:"id"`
+			Text string `json:"text"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&sign)
+		response.Body.Close()
+		assertNoError(t, err)
+		assertEqual(t, response.StatusCode, http.StatusOK)
+		got, err := c.GetSign(ctx, &pb.GetSignRequest{Id: sign.Id})
+		assertNoError(t, err)
+		assertEqual(t, got.Text, "Hello")
+	}
+	// Get a kiosk with a gRPC-Web request, as a browser would.
+	{
+		message, err := proto.Marshal(&pb.GetKioskRequest{Id: kiosk_id})
+		assertNoError(t, err)
+		frame := make([]byte, 5+len(message))
+		binary.BigEndian.PutUint32(frame[1:5], uint32(len(message)))
+		copy(frame[5:], message)
+		request, err := http.NewRequest("POST", httpAddress()+"/kiosk.Display/GetKiosk", bytes.NewReader(frame))
+		assertNoError(t, err)
+		request.Header.Set("Content-Type", "application/grpc-web+proto")
+		response, err := http.DefaultClient.Do(request)
+		assertNoError(t, err)
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assertNoError(t, err)
+		// The first frame holds the response message and the last the trailers.
+		if len(body) < 5 || body[0] != 0 {
+			t.Fatalf("unexpected gRPC-Web response %q", body)
+		}
+		length := binary.BigEndian.Uint32(body[1:5])
+		kiosk := &pb.Kiosk{}
+		err = proto.Unmarshal(body[5:5+length], kiosk)
+		assertNoError(t, err)
+		assertEqual(t, kiosk.Name, "foo")
+	}
+	// Watch the kiosk's sign as Server-Sent Events and verify that the
+	// first event is its current sign.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		current, err := c.GetSignIdForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{KioskId: kiosk_id})
+		assertNoError(t, err)
+		watchCtx, stop := context.WithTimeout(ctx, time.Second)
+		request, err := http.NewRequestWithContext(watchCtx, "GET", fmt.Sprintf("%s/v1/kiosks/%d/sign:watch", httpAddress(), kiosk_id), nil)
+		assertNoError(t, err)
+		response, err := http.DefaultClient.Do(request)
+		assertNoError(t, err)
+		assertEqual(t, response.Header.Get("Content-Type"), "text/event-stream")
+		var event struct {
+			SignId int32 `json:"signId"`
+		}
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				err = json.Unmarshal([]byte(data), &event)
+				break
+			}
+		}
+		response.Body.Close()
+		stop()
+		assertNoError(t, err)
+		assertEqual(t, event.SignId, current.SignId)
+	}
+	// Watch the kiosk's sign from a page on an origin that isn't allowed and
+	// verify that the request is refused.
+	{
+		request, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/kiosks/%d/sign:watch", httpAddress(), kiosk_id), nil)
+		assertNoError(t, err)
+		request.Header.Set("Origin", "https://not-allowed.example.com")
+		response, err := http.DefaultClient.Do(request)
+		assertNoError(t, err)
+		response.Body.Close()
+		assertEqual(t, response.StatusCode, http.StatusForbidden)
+	}
+	// Verify that the Display service reports that it is serving.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		health := healthpb.NewHealthClient(conn)
+		response, err := health.Check(ctx, &healthpb.HealthCheckRequest{Service: "kiosk.Display"})
+		assertNoError(t, err)
+		assertEqual(t, response.Status, healthpb.HealthCheckResponse_SERVING)
+	}
+	// Verify that the admin server counts the RPCs made above.
+	{
+		host := os.Getenv("KIOSK_SERVER")
+		if host == "" {
+			host = "localhost"
+		}
+		port := os.Getenv("KIOSK_ADMIN_PORT")
+		if port == "" {
+			port = "9090"
+		}
+		response, err := http.Get("http://" + host + ":" + port + "/metrics")
+		assertNoError(t, err)
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assertNoError(t, err)
+		assertEqual(t, strings.Contains(string(body), `grpc_server_handled_total{grpc_code="OK",grpc_method="/kiosk.Display/GetKiosk"}`), true)
+		assertEqual(t, strings.Contains(string(body), "kiosk_kiosks "), true)
+	}
+	// Verify that request IDs are returned in the response headers.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var header metadata.MD
+		requestCtx := metadata.AppendToOutgoingContext(ctx, "x-request-id", "test-request")
+		_, err := c.GetKiosk(requestCtx, &pb.GetKioskRequest{Id: kiosk_id}, grpc.Header(&header))
+		assertNoError(t, err)
+		assertEqual(t, strings.Join(header.Get("x-request-id"), ","), "test-request")
+		response, err := http.Get(fmt.Sprintf("%s/v1/kiosks/%d", httpAddress(), kiosk_id))
+		assertNoError(t, err)
+		response.Body.Close()
+		assertEqual(t, response.Header.Get("X-Request-Id") != "", true)
+	}
+	// Update the kiosk with a made-up API key and verify that the audit log
+	// doesn't believe it, since the test doesn't come through a trusted
+	// proxy.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		spoofCtx := metadata.AppendToOutgoingContext(ctx, "x-api-key", "spoofed-key")
+		kiosk, err := c.GetKiosk(ctx, &pb.GetKioskRequest{Id: kiosk_id})
+		assertNoError(t, err)
+		_, err = c.UpdateKiosk(spoofCtx, kiosk)
+		assertNoError(t, err)
+		response, err := c.ListAuditEvents(ctx, &pb.ListAuditEventsRequest{
+			Resource: fmt.Sprintf("kiosks/%d", kiosk_id),
+			PageSize: 1,
+		})
+		assertNoError(t, err)
+		assertEqual(t, len(response.Events), 1)
+		assertEqual(t, response.Events[0].Method, "UpdateKiosk")
+		assertEqual(t, strings.HasPrefix(response.Events[0].Principal, "apikey:"), false)
+	}
+	// Create a sign with an image and verify that the audit log records the
+	// sign without it.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		sign, err := c.CreateSign(ctx, &pb.Sign{Name: "picture", Text: "Hello", Image: []byte("image")})
+		assertNoError(t, err)
+		response, err := c.ListAuditEvents(ctx, &pb.ListAuditEventsRequest{
+			Resource: fmt.Sprintf("signs/%d", sign.Id),
+			PageSize: 1,
+		})
+		assertNoError(t, err)
+		assertEqual(t, len(response.Events), 1)
+		logged := &pb.Sign{}
+		err = response.Events[0].After.UnmarshalTo(logged)
+		assertNoError(t, err)
+		assertEqual(t, logged.Text, "Hello")
+		assertEqual(t, len(logged.Image), 0)
+		_, err = c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: sign.Id})
+		assertNoError(t, err)
+	}
+	// If the server limits the streams watching a kiosk, fill the quota and
+	// verify that another stream, or a watch request, is asked to retry.
+	// Then drop a stream and verify that a new one is admitted.
+	if max, err := strconv.Atoi(os.Getenv("KIOSK_MAX_STREAMS_PER_KIOSK")); err == nil && max > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		kiosk, err := c.CreateKiosk(ctx, &pb.Kiosk{Name: "quota"})
+		assertNoError(t, err)
+		dropCtx, drop := context.WithCancel(ctx)
+		for i := 0; i < max; i++ {
+			streamCtx := ctx
+			if i == 0 {
+				streamCtx = dropCtx
+			}
+			stream, err := c.GetSignIdsForKioskId(streamCtx, &pb.GetSignIdForKioskIdRequest{KioskId: kiosk.Id})
+			assertNoError(t, err)
+			_, err = stream.Recv()
+			assertNoError(t, err)
+		}
+		stream, err := c.GetSignIdsForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{KioskId: kiosk.Id})
+		assertNoError(t, err)
+		_, err = stream.Recv()
+		st := status.Convert(err)
+		assertEqual(t, st.Code(), codes.ResourceExhausted)
+		assertEqual(t, len(st.Details()), 1)
+		_, ok := st.Details()[0].(*errdetails.RetryInfo)
+		assertEqual(t, ok, true)
+		response, err := http.Get(fmt.Sprintf("%s/v1/kiosks/%d/sign:watch", httpAddress(), kiosk.Id))
+		assertNoError(t, err)
+		response.Body.Close()
+		assertEqual(t, response.StatusCode, http.StatusTooManyRequests)
+		assertEqual(t, response.Header.Get("Retry-After") != "", true)
+		drop()
+		for {
+			stream, err := c.GetSignIdsForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{KioskId: kiosk.Id})
+			assertNoError(t, err)
+			_, err = stream.Recv()
+			if status.Code(err) != codes.ResourceExhausted || ctx.Err() != nil {
+				assertNoError(t, err)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}
+	// Update the kiosk with a stale etag and verify that it fails with
+	// Aborted, then update it with its current etag.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		kiosk, err := c.GetKiosk(ctx, &pb.GetKioskRequest{Id: kiosk_id})
+		assertNoError(t, err)
+		stale := kiosk.Etag
+		kiosk, err = c.UpdateKiosk(ctx, kiosk)
+		assertNoError(t, err)
+		assertEqual(t, kiosk.Etag != stale, true)
+		_, err = c.UpdateKiosk(ctx, &pb.Kiosk{Id: kiosk_id, Name: kiosk.Name, Etag: stale})
+		assertEqual(t, status.Code(err), codes.Aborted)
+		_, err = c.UpdateKiosk(ctx, kiosk)
+		assertNoError(t, err)
+	}
+	// Delete a sign and verify that it is only listed with show_deleted,
+	// then undelete it.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		sign, err := c.CreateSign(ctx, &pb.Sign{Name: "D"})
+		assertNoError(t, err)
+		_, err = c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: sign.Id})
+		assertNoError(t, err)
+		listed := func(showDeleted bool) *pb.Sign {
+			response, err := c.ListSigns(ctx, &pb.ListSignsRequest{ShowDeleted: showDeleted})
+			assertNoError(t, err)
+			for _, s := range response.Signs {
+				if s.Id == sign.Id {
+					return s
+				}
+			}
+			return nil
+		}
+		assertEqual(t, listed(false) == nil, true)
+		deleted := listed(true)
+		assertEqual(t, deleted != nil && deleted.DeleteTime != nil, true)
+		restored, err := c.UndeleteSign(ctx, &pb.UndeleteSignRequest{Id: sign.Id})
+		assertNoError(t, err)
+		assertEqual(t, restored.DeleteTime == nil, true)
+		assertEqual(t, listed(false) != nil, true)
+		_, err = c.UndeleteSign(ctx, &pb.UndeleteSignRequest{Id: sign.Id})
+		assertEqual(t, status.Code(err), codes.FailedPrecondition)
+		_, err = c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: sign.Id})
+		assertNoError(t, err)
+	}
+	// Change the text of a sign, verify that both revisions are kept and
+	// roll back to the first one. Once the sign is made from a template, it
+	// can't be rolled back to text of its own.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		sign, err := c.CreateSign(ctx, &pb.Sign{Name: "E", Text: "one"})
+		assertNoError(t, err)
+		sign.Text = "two"
+		sign, err = c.UpdateSign(ctx, sign)
+		assertNoError(t, err)
+		assertEqual(t, sign.RevisionId, int32(2))
+		response, err := c.ListSignRevisions(ctx, &pb.ListSignRevisionsRequest{SignId: sign.Id})
+		assertNoError(t, err)
+		assertEqual(t, len(response.Revisions), 2)
+		revision, err := c.GetSignRevision(ctx, &pb.GetSignRevisionRequest{SignId: sign.Id, RevisionId: 1})
+		assertNoError(t, err)
+		assertEqual(t, revision.Text, "one")
+		sign, err = c.RollbackSign(ctx, &pb.RollbackSignRequest{SignId: sign.Id, RevisionId: 1})
+		assertNoError(t, err)
+		assertEqual(t, sign.Text, "one")
+		assertEqual(t, sign.RevisionId, int32(3))
+		template, err := c.CreateSignTemplate(ctx, &pb.SignTemplate{Name: "rollback", Text: "Three"})
+		assertNoError(t, err)
+		sign.Text = ""
+		sign.TemplateId = template.Id
+		sign, err = c.UpdateSign(ctx, sign)
+		assertNoError(t, err)
+		_, err = c.RollbackSign(ctx, &pb.RollbackSignRequest{SignId: sign.Id, RevisionId: 1})
+		assertEqual(t, status.Code(err), codes.InvalidArgument)
+		_, err = c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: sign.Id})
+		assertNoError(t, err)
+	}
+	// Create signs in a batch, verify that a batch get reports the invalid
+	// id, and delete them in a batch that fails as a whole.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		response, err := c.BatchCreateSigns(ctx, &pb.BatchCreateSignsRequest{
+			Signs:        []*pb.Sign{{Name: "F"}, {Name: "G"}},
+			AllOrNothing: true,
+		})
+		assertNoError(t, err)
+		assertEqual(t, len(response.Signs), 2)
+		ids := []int32{response.Signs[0].Id, response.Signs[1].Id}
+		got, err := c.BatchGetSigns(ctx, &pb.BatchGetSignsRequest{Ids: append(ids, -1)})
+		assertNoError(t, err)
+		assertEqual(t, len(got.Statuses), 3)
+		assertEqual(t, got.Signs[1].Name, "G")
+		assertEqual(t, codes.Code(got.Statuses[0].Code), codes.OK)
+		assertEqual(t, codes.Code(got.Statuses[2].Code) != codes.OK, true)
+		_, err = c.BatchDeleteSigns(ctx, &pb.BatchDeleteSignsRequest{Ids: append(ids, -1), AllOrNothing: true})
+		assertEqual(t, err != nil, true)
+		sign, err := c.GetSign(ctx, &pb.GetSignRequest{Id: ids[0]})
+		assertNoError(t, err)
+		assertEqual(t, sign.DeleteTime == nil, true)
+		_, err = c.BatchDeleteSigns(ctx, &pb.BatchDeleteSignsRequest{Ids: ids, AllOrNothing: true})
+		assertNoError(t, err)
+	}
+	// Create kiosks and signs in all-or-nothing batches with an invalid item
+	// in the middle, and verify that nothing is created.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		kiosks, err := c.ListKiosks(ctx, &pb.ListKiosksRequest{})
+		assertNoError(t, err)
+		signs, err := c.ListSigns(ctx, &pb.ListSignsRequest{})
+		assertNoError(t, err)
+		_, err = c.BatchCreateKiosks(ctx, &pb.BatchCreateKiosksRequest{
+			Kiosks: []*pb.Kiosk{
+				{Name: "H"},
+				{Name: "I", Variables: map[string]string{"not a name": "x"}},
+				{Name: "J"},
+			},
+			AllOrNothing: true,
+		})
+		assertEqual(t, status.Code(err), codes.InvalidArgument)
+		_, err = c.BatchCreateSigns(ctx, &pb.BatchCreateSignsRequest{
+			Signs:        []*pb.Sign{{Name: "K"}, {Name: "L", TemplateId: -1}, {Name: "M"}},
+			AllOrNothing: true,
+		})
+		assertEqual(t, status.Code(err), codes.InvalidArgument)
+		after, err := c.ListKiosks(ctx, &pb.ListKiosksRequest{})
+		assertNoError(t, err)
+		assertEqual(t, len(after.Kiosks), len(kiosks.Kiosks))
+		afterSigns, err := c.ListSigns(ctx, &pb.ListSignsRequest{})
+		assertNoError(t, err)
+		assertEqual(t, len(afterSigns.Signs), len(signs.Signs))
+	}
+	// Queue a command for a kiosk without a session, verify that it stays
+	// queued until a session receives it and is then delivered.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		kiosk, err := c.CreateKiosk(ctx, &pb.Kiosk{Name: "commands"})
+		assertNoError(t, err)
+		command, err := c.SendKioskCommand(ctx, &pb.KioskCommand{
+			KioskId: kiosk.Id,
+			Type:    pb.KioskCommand_IDENTIFY,
+		})
+		assertNoError(t, err)
+		assertEqual(t, command.State, pb.KioskCommand_QUEUED)
+		session, err := c.KioskSession(ctx)
+		assertNoError(t, err)
+		err = session.Send(&pb.KioskSessionRequest{
+			Message: &pb.KioskSessionRequest_Hello{Hello: &pb.KioskHello{KioskId: kiosk.Id}},
+		})
+		assertNoError(t, err)
+		for {
+			response, err := session.Recv()
+			assertNoError(t, err)
+			if response.GetCommand() != nil {
+				assertEqual(t, response.GetCommand().Id, command.Id)
+				break
+			}
+		}
+		for i := 0; i < 10 && command.State == pb.KioskCommand_QUEUED; i++ {
+			time.Sleep(10 * time.Millisecond)
+			command, err = c.GetKioskCommand(ctx, &pb.GetKioskCommandRequest{KioskId: kiosk.Id, Id: command.Id})
+			assertNoError(t, err)
+		}
+		assertEqual(t, command.State, pb.KioskCommand_DELIVERED)
+		session.CloseSend()
+	}
+	// Watch a kiosk's signs and commands, send it a command and verify that
+	// it arrives on the stream and is delivered. Then fill the kiosk's
+	// commands and verify that another one is refused.
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		kiosk, err := c.CreateKiosk(ctx, &pb.Kiosk{Name: "commands"})
+		assertNoError(t, err)
+		stream, err := c.GetSignIdsForKioskId(ctx, &pb.GetSignIdForKioskIdRequest{
+			KioskId:         kiosk.Id,
+			IncludeCommands: true,
+		})
+		assertNoError(t, err)
+		_, err = stream.Recv()
+		assertNoError(t, err)
+		command, err := c.SendKioskCommand(ctx, &pb.KioskCommand{
+			KioskId: kiosk.Id,
+			Type:    pb.KioskCommand_REFRESH,
+		})
+		assertNoError(t, err)
+		response, err := stream.Recv()
+		assertNoError(t, err)
+		assertEqual(t, response.GetCommand().GetId(), command.Id)
+		for command.State == pb.KioskCommand_QUEUED && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+			command, err = c.GetKioskCommand(ctx, &pb.GetKioskCommandRequest{KioskId: kiosk.Id, Id: command.Id})
+			assertNoError(t, err)
+		}
+		assertEqual(t, command.State, pb.KioskCommand_DELIVERED)
+		for i := 1; i < 100; i++ {
+			_, err = c.SendKioskCommand(ctx, &pb.KioskCommand{
+				KioskId: kiosk.Id,
+				Type:    pb.KioskCommand_REFRESH,
+			})
+			assertNoError(t, err)
+		}
+		_, err = c.SendKioskCommand(ctx, &pb.KioskCommand{
+			KioskId: kiosk.Id,
+			Type:    pb.KioskCommand_REFRESH,
+		})
+		assertEqual(t, status.Code(err), codes.ResourceExhausted)
+		cancel()
+	}
 	// Delete all kiosks.
 	{
-		response, err := c.ListKiosks(ctx, &empty.Empty{})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		response, err := c.ListKiosks(ctx, &pb.ListKiosksRequest{})
 		assertNoError(t, err)
 		for _, k := range response.Kiosks {
 			_, err := c.DeleteKiosk(ctx, &pb.DeleteKioskRequest{Id: int32(k.Id)})
@@ -179,7 +1091,9 @@ func TestKiosk(t *testing.T) {
 	}
 	// Delete all signs.
 	{
-		response, err := c.ListSigns(ctx, &empty.Empty{})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		response, err := c.ListSigns(ctx, &pb.ListSignsRequest{})
 		assertNoError(t, err)
 		for _, s := range response.Signs {
 			_, err := c.DeleteSign(ctx, &pb.DeleteSignRequest{Id: int32(s.Id)})
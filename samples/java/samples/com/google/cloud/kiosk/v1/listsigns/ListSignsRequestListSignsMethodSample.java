@@ -20,7 +20,7 @@
 public class ListSignsRequestListSignsMethodSample {
   public static void main(String[] args) {
     // [START sample_core]
-    Empty request = Empty.newBuilder().build();
+    ListSignsRequest request = ListSignsRequest.newBuilder().build();
     ListSignsResponse response = displayClient.listSigns(request);
     for (Sign sign : response.getSignsList()) {
       System.out.printf("Sign: %s\n", sign);
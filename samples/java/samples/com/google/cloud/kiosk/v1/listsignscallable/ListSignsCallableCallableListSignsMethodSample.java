@@ -20,7 +20,7 @@
 public class ListSignsCallableCallableListSignsMethodSample {
   public static void main(String[] args) {
     // [START sample_core]
-    Empty request = Empty.newBuilder().build();
+    ListSignsRequest request = ListSignsRequest.newBuilder().build();
     ApiFuture<ListSignsResponse> future = displayClient.listSignsCallable().futureCall(request);
 
     // Do something
@@ -0,0 +1,290 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// AuditLog appends audit events to a file as lines of JSON. When the file
+// grows past MaxBytes it is renamed with the suffix ".1" (shifting older
+// files to ".2" and so on) and a new file is started. At most MaxFiles
+// rotated files are kept.
+type AuditLog struct {
+	Path     string
+	MaxBytes int64
+	MaxFiles int
+	file     *os.File
+	size     int64
+	nextId   int64
+	mux      sync.Mutex
+}
+
+// OpenAuditLog opens the audit log at path, creating it if necessary.
+func OpenAuditLog(path string, maxBytes int64, maxFiles int) (*AuditLog, error) {
+	l := &AuditLog{Path: path, MaxBytes: maxBytes, MaxFiles: maxFiles, nextId: 1}
+	// Continue numbering events after the last one that was logged.
+	err := l.scan(func(e *pb.AuditEvent) {
+		if e.Id >= l.nextId {
+			l.nextId = e.Id + 1
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotated returns the name of the nth rotated file.
+func (l *AuditLog) rotated(n int) string {
+	return fmt.Sprintf("%s.%d", l.Path, n)
+}
+
+func (l *AuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(l.rotated(l.MaxFiles))
+	for n := l.MaxFiles - 1; n >= 1; n-- {
+		if _, err := os.Stat(l.rotated(n)); err == nil {
+			if err := os.Rename(l.rotated(n), l.rotated(n+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if l.MaxFiles > 0 {
+		if err := os.Rename(l.Path, l.rotated(1)); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(l.Path)
+	}
+	return l.open()
+}
+
+// Append assigns an id to an event and writes it to the log.
+func (l *AuditLog) Append(e *pb.AuditEvent) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	e.Id = l.nextId
+	b, err := protojson.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if l.size > 0 && l.size+int64(len(b)) > l.MaxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.nextId++
+	return nil
+}
+
+// Close closes the log.
+func (l *AuditLog) Close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.file.Close()
+}
+
+// Query calls fn with each logged event, oldest first.
+func (l *AuditLog) Query(fn func(*pb.AuditEvent)) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.scan(fn)
+}
+
+func (l *AuditLog) scan(fn func(*pb.AuditEvent)) error {
+	paths := []string{}
+	for n := l.MaxFiles; n >= 1; n-- {
+		paths = append(paths, l.rotated(n))
+	}
+	paths = append(paths, l.Path)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 64<<20)
+		for scanner.Scan() {
+			e := &pb.AuditEvent{}
+			if err := protojson.Unmarshal(scanner.Bytes(), e); err != nil {
+				file.Close()
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			fn(e)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kioskName returns the audit resource name of a kiosk.
+func kioskName(id int32) string {
+	return fmt.Sprintf("kiosks/%d", id)
+}
+
+// signName returns the audit resource name of a sign.
+func signName(id int32) string {
+	return fmt.Sprintf("signs/%d", id)
+}
+
+// audit records a change in the audit log, if there is one. before and after
+// may be nil for resources that didn't exist before or after the change. It
+// must be called with s.mux held so that events are logged in the order that
+// changes are made.
+func (s *DisplayServer) audit(ctx context.Context, method string, resource string, request, before, after proto.Message) {
+	if s.AuditLog == nil {
+		return
+	}
+	e := &pb.AuditEvent{
+		Time:      timestamppb.Now(),
+		Principal: Principal(ctx),
+		Method:    method,
+		Resource:  resource,
+		RequestId: RequestID(ctx),
+	}
+	var err error
+	if e.Request, err = marshalAny(request); err == nil {
+		if e.Before, err = marshalAny(before); err == nil {
+			e.After, err = marshalAny(after)
+		}
+	}
+	if err == nil {
+		err = s.AuditLog.Append(e)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to write audit event", "method", method, "resource", resource, "error", err)
+	}
+}
+
+func marshalAny(m proto.Message) (*anypb.Any, error) {
+	if m == nil {
+		return nil, nil
+	}
+	return anypb.New(withoutImages(m))
+}
+
+// withoutImages returns a copy of m with the images of m and the messages it
+// contains removed, so that the log doesn't fill up with image bytes.
+func withoutImages(m proto.Message) proto.Message {
+	m = proto.Clone(m)
+	clearImages(m.ProtoReflect())
+	return m
+}
+
+func clearImages(m protoreflect.Message) {
+	images := []protoreflect.FieldDescriptor{}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+					clearImages(v.Message())
+					return true
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				for i := 0; i < v.List().Len(); i++ {
+					clearImages(v.List().Get(i).Message())
+				}
+			}
+		case fd.Message() != nil:
+			clearImages(v.Message())
+		case fd.Name() == "image" && fd.Kind() == protoreflect.BytesKind:
+			images = append(images, fd)
+		}
+		return true
+	})
+	for _, fd := range images {
+		m.Clear(fd)
+	}
+}
+
+// ListAuditEvents returns recorded changes that match a filter.
+func (s *DisplayServer) ListAuditEvents(c context.Context, r *pb.ListAuditEventsRequest) (*pb.ListAuditEventsResponse, error) {
+	if s.AuditLog == nil {
+		return nil, status.Error(codes.FailedPrecondition, "audit log is disabled")
+	}
+	response := &pb.ListAuditEventsResponse{}
+	err := s.AuditLog.Query(func(e *pb.AuditEvent) {
+		if r.Resource != "" && e.Resource != r.Resource && !strings.HasPrefix(e.Resource, r.Resource+"/") {
+			return
+		}
+		if r.Principal != "" && e.Principal != r.Principal {
+			return
+		}
+		if r.StartTime != nil && e.Time.AsTime().Before(r.StartTime.AsTime()) {
+			return
+		}
+		if r.EndTime != nil && !e.Time.AsTime().Before(r.EndTime.AsTime()) {
+			return
+		}
+		response.Events = append(response.Events, e)
+		if r.PageSize > 0 && len(response.Events) > int(r.PageSize) {
+			response.Events = response.Events[1:]
+		}
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "reading audit log: %v", err)
+	}
+	return response, nil
+}
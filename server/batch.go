@@ -0,0 +1,229 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// itemStatus returns the status of an item of a batch request.
+func itemStatus(err error) *spb.Status {
+	return status.Convert(err).Proto()
+}
+
+// itemError returns an error for a batch request that failed because one of
+// its items would fail.
+func itemError(field string, i int, err error) error {
+	st := status.Convert(err)
+	return status.Errorf(st.Code(), "%s[%d]: %s", field, i, st.Message())
+}
+
+// checkRequestIds returns an error if a request id is used for different
+// requests within a batch or in an earlier request to method. It returns
+// the number of items that aren't retries, which will create resources.
+// It must be called with s.mux held.
+func (s *DisplayServer) checkRequestIds(field string, method string, requestIDs []string, hashes [][sha256.Size]byte) (int, error) {
+	seen := make(map[string][sha256.Size]byte)
+	created := 0
+	for i, requestID := range requestIDs {
+		if requestID != "" {
+			if hash, ok := seen[requestID]; ok {
+				if hash != hashes[i] {
+					return 0, itemError(field, i, status.Errorf(codes.InvalidArgument, "request_id %q is used for different requests", requestID))
+				}
+				continue
+			}
+			seen[requestID] = hashes[i]
+			result, err := s.lookupRequest(method, requestID, hashes[i])
+			if err != nil {
+				return 0, itemError(field, i, err)
+			} else if result != nil {
+				continue
+			}
+		}
+		created++
+	}
+	return created, nil
+}
+
+// BatchCreateKiosks creates several kiosks.
+func (s *DisplayServer) BatchCreateKiosks(c context.Context, r *pb.BatchCreateKiosksRequest) (*pb.BatchCreateKiosksResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if r.AllOrNothing {
+		requestIDs := make([]string, len(r.Kiosks))
+		hashes := make([][sha256.Size]byte, len(r.Kiosks))
+		for i, kiosk := range r.Kiosks {
+			if err := checkVariables(kiosk.Variables); err != nil {
+				return nil, itemError("kiosks", i, err)
+			}
+			requestIDs[i], hashes[i] = kiosk.RequestId, kioskRequestHash(kiosk)
+		}
+		created, err := s.checkRequestIds("kiosks", "CreateKiosk", requestIDs, hashes)
+		if err != nil {
+			return nil, err
+		}
+		if max := s.Quotas.MaxKiosks; max > 0 && s.activeKiosks()+created > max {
+			return nil, resourceExhausted(quotaRetryDelay, "%d more kiosks would exceed the limit of %d", created, max)
+		}
+	}
+	response := &pb.BatchCreateKiosksResponse{}
+	for _, kiosk := range r.Kiosks {
+		created, err := s.createKiosk(c, "BatchCreateKiosks", kiosk)
+		if created == nil {
+			created = &pb.Kiosk{}
+		}
+		response.Kiosks = append(response.Kiosks, created)
+		response.Statuses = append(response.Statuses, itemStatus(err))
+	}
+	return response, nil
+}
+
+// BatchGetKiosks returns several kiosks.
+func (s *DisplayServer) BatchGetKiosks(c context.Context, r *pb.BatchGetKiosksRequest) (*pb.BatchGetKiosksResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	response := &pb.BatchGetKiosksResponse{}
+	for _, id := range r.Ids {
+		var err error
+		kiosk := s.kiosks[id]
+		if kiosk == nil {
+			kiosk = &pb.Kiosk{}
+			err = errors.New("invalid kiosk id")
+		} else {
+			kiosk = s.withStatus(kiosk, now)
+		}
+		response.Kiosks = append(response.Kiosks, kiosk)
+		response.Statuses = append(response.Statuses, itemStatus(err))
+	}
+	return response, nil
+}
+
+// BatchDeleteKiosks deletes several kiosks.
+func (s *DisplayServer) BatchDeleteKiosks(c context.Context, r *pb.BatchDeleteKiosksRequest) (*pb.BatchDeleteKiosksResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if r.AllOrNothing {
+		seen := make(map[int32]bool)
+		for i, id := range r.Ids {
+			if s.activeKiosk(id) == nil || seen[id] {
+				return nil, itemError("ids", i, errors.New("invalid kiosk id"))
+			}
+			seen[id] = true
+		}
+	}
+	response := &pb.BatchDeleteKiosksResponse{}
+	for _, id := range r.Ids {
+		err := s.deleteKiosk(c, "BatchDeleteKiosks", r, id, "")
+		response.Statuses = append(response.Statuses, itemStatus(err))
+	}
+	return response, nil
+}
+
+// BatchCreateSigns creates several signs.
+func (s *DisplayServer) BatchCreateSigns(c context.Context, r *pb.BatchCreateSignsRequest) (*pb.BatchCreateSignsResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if r.AllOrNothing {
+		requestIDs := make([]string, len(r.Signs))
+		hashes := make([][sha256.Size]byte, len(r.Signs))
+		for i, sign := range r.Signs {
+			if err := s.checkSignTemplate(sign); err != nil {
+				return nil, itemError("signs", i, err)
+			}
+			requestIDs[i], hashes[i] = sign.RequestId, signRequestHash(sign)
+		}
+		created, err := s.checkRequestIds("signs", "CreateSign", requestIDs, hashes)
+		if err != nil {
+			return nil, err
+		}
+		if max := s.Quotas.MaxSigns; max > 0 && s.activeSigns()+created > max {
+			return nil, resourceExhausted(quotaRetryDelay, "%d more signs would exceed the limit of %d", created, max)
+		}
+		if max := s.Quotas.MaxImageBytes; max > 0 {
+			uncounted := s.uncountedImages()
+			imageBytes := s.countedImageBytes(uncounted)
+			added := make(map[string]bool)
+			for _, sign := range r.Signs {
+				hash := imageHash(sign.Image)
+				if hash != "" && (s.images[hash] == nil || uncounted[hash]) && !added[hash] {
+					imageBytes += int64(len(sign.Image))
+					added[hash] = true
+				}
+			}
+			if imageBytes > max {
+				return nil, resourceExhausted(quotaRetryDelay, "images would exceed %d bytes", max)
+			}
+		}
+	}
+	response := &pb.BatchCreateSignsResponse{}
+	for _, sign := range r.Signs {
+		created, err := s.createSign(c, "BatchCreateSigns", sign)
+		if created == nil {
+			created = &pb.Sign{}
+		}
+		response.Signs = append(response.Signs, created)
+		response.Statuses = append(response.Statuses, itemStatus(err))
+	}
+	return response, nil
+}
+
+// BatchGetSigns returns several signs.
+func (s *DisplayServer) BatchGetSigns(c context.Context, r *pb.BatchGetSignsRequest) (*pb.BatchGetSignsResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	response := &pb.BatchGetSignsResponse{}
+	for _, id := range r.Ids {
+		var err error
+		sign := s.signs[id]
+		if sign == nil {
+			sign = &pb.Sign{}
+			err = errors.New("invalid sign id")
+		}
+		response.Signs = append(response.Signs, sign)
+		response.Statuses = append(response.Statuses, itemStatus(err))
+	}
+	return response, nil
+}
+
+// BatchDeleteSigns deletes several signs.
+func (s *DisplayServer) BatchDeleteSigns(c context.Context, r *pb.BatchDeleteSignsRequest) (*pb.BatchDeleteSignsResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if r.AllOrNothing {
+		seen := make(map[int32]bool)
+		for i, id := range r.Ids {
+			if s.activeSign(id) == nil || seen[id] {
+				return nil, itemError("ids", i, errors.New("invalid sign id"))
+			}
+			seen[id] = true
+		}
+	}
+	response := &pb.BatchDeleteSignsResponse{}
+	for _, id := range r.Ids {
+		err := s.deleteSign(c, "BatchDeleteSigns", r, id, "")
+		response.Statuses = append(response.Statuses, itemStatus(err))
+	}
+	return response, nil
+}
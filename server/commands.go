@@ -0,0 +1,230 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxCommandsPerKiosk is the number of commands kept for each kiosk. The
+// oldest finished commands are forgotten to make room for new ones.
+const maxCommandsPerKiosk = 100
+
+// commandName returns the audit resource name of a command.
+func commandName(kioskID int32, id int32) string {
+	return fmt.Sprintf("kiosks/%d/commands/%d", kioskID, id)
+}
+
+// finished returns true if a command will not change again.
+func finished(command *pb.KioskCommand) bool {
+	switch command.State {
+	case pb.KioskCommand_SUCCEEDED, pb.KioskCommand_FAILED, pb.KioskCommand_EXPIRED:
+		return true
+	}
+	return false
+}
+
+// expireCommands marks the queued commands of a kiosk that have expired. It
+// must be called with s.mux held.
+func (s *DisplayServer) expireCommands(kioskID int32, now time.Time) {
+	for _, command := range s.commands[kioskID] {
+		if command.State == pb.KioskCommand_QUEUED && command.ExpireTime != nil && command.ExpireTime.AsTime().Before(now) {
+			command.State = pb.KioskCommand_EXPIRED
+			command.CompleteTime = command.ExpireTime
+		}
+	}
+}
+
+// commandMessage returns a command as a message for a session. It must be
+// called with s.mux held.
+func commandMessage(command *pb.KioskCommand) *pb.KioskSessionResponse {
+	return &pb.KioskSessionResponse{
+		Message: &pb.KioskSessionResponse_Command{Command: proto.Clone(command).(*pb.KioskCommand)},
+	}
+}
+
+// queuedCommands returns copies of the queued commands of a kiosk, for a
+// session or stream that is starting. It must be called with s.mux held.
+func (s *DisplayServer) queuedCommands(kioskID int32) []*pb.KioskCommand {
+	s.expireCommands(kioskID, time.Now())
+	commands := []*pb.KioskCommand{}
+	for _, command := range s.commands[kioskID] {
+		if command.State == pb.KioskCommand_QUEUED {
+			commands = append(commands, proto.Clone(command).(*pb.KioskCommand))
+		}
+	}
+	return commands
+}
+
+// delivered marks a command as delivered once a session or stream has sent
+// it, if it is still queued. Commands stay queued until then, so that those
+// lost with a connection are sent again when the kiosk reconnects. It does
+// nothing if sent is nil, and acquires s.mux itself.
+func (s *DisplayServer) delivered(kioskID int32, sent *pb.KioskCommand) {
+	if sent == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.markDelivered(kioskID, sent.Id)
+}
+
+// markDelivered marks a command as delivered if it is still queued. It must
+// be called with s.mux held.
+func (s *DisplayServer) markDelivered(kioskID int32, id int32) {
+	for _, command := range s.commands[kioskID] {
+		if command.Id == id && command.State == pb.KioskCommand_QUEUED {
+			command.State = pb.KioskCommand_DELIVERED
+			command.DeliverTime = timestamppb.Now()
+		}
+	}
+}
+
+// command returns a command for a kiosk, or an error if there is no such
+// command. It must be called with s.mux held.
+func (s *DisplayServer) command(kioskID int32, id int32) (*pb.KioskCommand, error) {
+	if s.kiosks[kioskID] == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	s.expireCommands(kioskID, time.Now())
+	for _, command := range s.commands[kioskID] {
+		if command.Id == id {
+			return command, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "kiosk %d has no command %d", kioskID, id)
+}
+
+// SendKioskCommand queues a command for a kiosk and sends it to the kiosk's
+// sessions and to its streams that ask for commands, if it has any. If the
+// kiosk already has as many unfinished commands as are kept, the command
+// is refused.
+func (s *DisplayServer) SendKioskCommand(c context.Context, r *pb.KioskCommand) (*pb.KioskCommand, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeKiosk(r.KioskId) == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	if r.Type == pb.KioskCommand_TYPE_UNSPECIFIED {
+		return nil, status.Error(codes.InvalidArgument, "a command type is required")
+	}
+	now := time.Now()
+	if r.ExpireTime != nil && (r.ExpireTime.CheckValid() != nil || r.ExpireTime.AsTime().Before(now)) {
+		return nil, status.Error(codes.InvalidArgument, "expire_time must be in the future")
+	}
+	command := &pb.KioskCommand{
+		Id:         s.nextCommandId,
+		KioskId:    r.KioskId,
+		Type:       r.Type,
+		ExpireTime: r.ExpireTime,
+		State:      pb.KioskCommand_QUEUED,
+		Creator:    Principal(c),
+		CreateTime: timestamppb.New(now),
+	}
+	s.expireCommands(r.KioskId, now)
+	commands := s.commands[r.KioskId]
+	if excess := len(commands) - maxCommandsPerKiosk + 1; excess > 0 {
+		kept := []*pb.KioskCommand{}
+		for _, old := range commands {
+			if excess > 0 && finished(old) {
+				excess--
+				continue
+			}
+			kept = append(kept, old)
+		}
+		commands = kept
+	}
+	if len(commands) >= maxCommandsPerKiosk {
+		return nil, resourceExhausted(quotaRetryDelay, "kiosk %d already has %d unfinished commands", r.KioskId, maxCommandsPerKiosk)
+	}
+	s.nextCommandId++
+	s.commands[r.KioskId] = append(commands, command)
+	s.sendToSessions(r.KioskId, commandMessage(command))
+	s.notify(r.KioskId, signUpdate{command: proto.Clone(command).(*pb.KioskCommand), published: now})
+	s.audit(c, "SendKioskCommand", commandName(r.KioskId, command.Id), r, nil, command)
+	return proto.Clone(command).(*pb.KioskCommand), nil
+}
+
+// ListKioskCommands returns the recent commands for the kiosk with ID
+// r.KioskId.
+func (s *DisplayServer) ListKioskCommands(c context.Context, r *pb.ListKioskCommandsRequest) (*pb.ListKioskCommandsResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.kiosks[r.KioskId] == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	s.expireCommands(r.KioskId, time.Now())
+	response := &pb.ListKioskCommandsResponse{}
+	for _, command := range s.commands[r.KioskId] {
+		response.Commands = append(response.Commands, proto.Clone(command).(*pb.KioskCommand))
+	}
+	return response, nil
+}
+
+// GetKioskCommand returns the command with ID r.Id for the kiosk with ID
+// r.KioskId.
+func (s *DisplayServer) GetKioskCommand(c context.Context, r *pb.GetKioskCommandRequest) (*pb.KioskCommand, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	command, err := s.command(r.KioskId, r.Id)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(command).(*pb.KioskCommand), nil
+}
+
+// ReportCommandResult records the result of a command that a kiosk ran.
+func (s *DisplayServer) ReportCommandResult(c context.Context, r *pb.ReportCommandResultRequest) (*pb.KioskCommand, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeKiosk(r.KioskId) == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	command, err := s.reportCommandResult(r.KioskId, r)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(command).(*pb.KioskCommand), nil
+}
+
+// reportCommandResult records the result of a command as described by
+// ReportCommandResult. It must be called with s.mux held.
+func (s *DisplayServer) reportCommandResult(kioskID int32, r *pb.ReportCommandResultRequest) (*pb.KioskCommand, error) {
+	command, err := s.command(kioskID, r.CommandId)
+	if err != nil {
+		return nil, err
+	}
+	if finished(command) {
+		return nil, status.Errorf(codes.FailedPrecondition, "command %d is %s", command.Id, command.State)
+	}
+	now := time.Now()
+	s.seen(kioskID, now)
+	command.State = pb.KioskCommand_SUCCEEDED
+	if codes.Code(r.Result.GetCode()) != codes.OK {
+		command.State = pb.KioskCommand_FAILED
+	}
+	command.Result = r.Result
+	command.CompleteTime = timestamppb.New(now)
+	return command, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"sort"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// dataReference matches a reference to the data feed in text.
+	dataReference = regexp.MustCompile(`\{\{\s*data\.([A-Za-z0-9_.-]+)\s*\}\}`)
+	// dataKey matches the keys of the data feed.
+	dataKey = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// dataName returns the audit resource name of a value in the data feed.
+func dataName(key string) string {
+	return "dataValues/" + key
+}
+
+// refersTo returns true if text refers to a key of the data feed.
+func refersTo(text string, key string) bool {
+	for _, match := range dataReference.FindAllStringSubmatch(text, -1) {
+		if match[1] == key {
+			return true
+		}
+	}
+	return false
+}
+
+// fillInData replaces the references to the data feed in text with their
+// values. References to values that aren't set are left as they are. It
+// must be called with s.mux held.
+func (s *DisplayServer) fillInData(text string) string {
+	return dataReference.ReplaceAllStringFunc(text, func(reference string) string {
+		if value := s.data[dataReference.FindStringSubmatch(reference)[1]]; value != nil {
+			return value.Value
+		}
+		return reference
+	})
+}
+
+// kioskTexts returns the text that a kiosk displays, on the whole screen
+// and in the regions of its layout, with template variables filled in but
+// not values from the data feed. It must be called with s.mux held.
+func (s *DisplayServer) kioskTexts(kioskID int32) []string {
+	texts := []string{}
+	for _, shown := range s.shownSigns(kioskID) {
+		texts = append(texts, s.signTexts(kioskID, shown.signID, shown.revisionID)...)
+	}
+	return texts
+}
+
+// signTexts returns the text of a revision of a sign, or of the latest
+// revision if revisionID is 0, as a kiosk displays it before values from
+// the data feed are filled in. It must be called with s.mux held.
+func (s *DisplayServer) signTexts(kioskID int32, signID int32, revisionID int32) []string {
+	sign := s.signs[signID]
+	if sign == nil {
+		return nil
+	}
+	if template := s.templates[sign.TemplateId]; template != nil {
+		variables := s.templateVariables(kioskID, sign.Id)
+		texts := []string{fillIn(template.Text, variables...)}
+		for _, overlay := range template.Overlays {
+			texts = append(texts, fillIn(overlay.Text, variables...))
+		}
+		return texts
+	}
+	if revisionID == 0 {
+		revisionID = sign.RevisionId
+	}
+	if revision := s.revision(sign.Id, revisionID); revision != nil {
+		return []string{revision.Text}
+	}
+	return nil
+}
+
+// dataChanged sends the assignments of the kiosks that display a value of
+// the data feed again, so that they fetch their effective signs again.
+// Their etags are left alone, since their assignments haven't changed. It
+// must be called with s.mux held.
+func (s *DisplayServer) dataChanged(key string) {
+	var kioskID int32
+	for kioskID = 1; kioskID < s.nextKioskId; kioskID++ {
+		if s.activeKiosk(kioskID) == nil {
+			continue
+		}
+		for _, text := range s.kioskTexts(kioskID) {
+			if refersTo(text, key) {
+				s.notify(kioskID, s.resendSignId(kioskID))
+				s.sendRegions(kioskID)
+				break
+			}
+		}
+	}
+}
+
+// SetDataValue sets a value in the data feed. Kiosks that display it are
+// sent their assignments again if it changed.
+func (s *DisplayServer) SetDataValue(c context.Context, r *pb.DataValue) (*pb.DataValue, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !dataKey.MatchString(r.Key) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid key %q", r.Key)
+	}
+	old := s.data[r.Key]
+	if old != nil && old.Value == r.Value {
+		return old, nil
+	}
+	value := &pb.DataValue{
+		Key:        r.Key,
+		Value:      r.Value,
+		UpdateTime: timestamppb.Now(),
+	}
+	s.data[r.Key] = value
+	var before proto.Message
+	if old != nil {
+		before = old
+	}
+	s.audit(c, "SetDataValue", dataName(r.Key), r, before, value)
+	s.dataChanged(r.Key)
+	return value, nil
+}
+
+// ListDataValues returns the values in the data feed, sorted by key.
+func (s *DisplayServer) ListDataValues(c context.Context, r *google_protobuf.Empty) (*pb.ListDataValuesResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	response := &pb.ListDataValuesResponse{}
+	for _, value := range s.data {
+		response.Values = append(response.Values, value)
+	}
+	sort.Slice(response.Values, func(i, j int) bool {
+		return response.Values[i].Key < response.Values[j].Key
+	})
+	return response, nil
+}
+
+// GetDataValue returns the value in the data feed with key r.Key.
+func (s *DisplayServer) GetDataValue(c context.Context, r *pb.GetDataValueRequest) (*pb.DataValue, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	value := s.data[r.Key]
+	if value == nil {
+		return nil, status.Errorf(codes.NotFound, "no value for key %q", r.Key)
+	}
+	return value, nil
+}
+
+// DeleteDataValue removes the value in the data feed with key r.Key. Kiosks
+// that displayed it are sent their assignments again.
+func (s *DisplayServer) DeleteDataValue(c context.Context, r *pb.DeleteDataValueRequest) (*google_protobuf.Empty, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	value := s.data[r.Key]
+	if value == nil {
+		return nil, status.Errorf(codes.NotFound, "no value for key %q", r.Key)
+	}
+	delete(s.data, r.Key)
+	s.audit(c, "DeleteDataValue", dataName(r.Key), r, value, nil)
+	s.dataChanged(r.Key)
+	return &google_protobuf.Empty{}, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newEtag returns an etag for a new version of a kiosk or sign. It must be
+// called with s.mux held.
+func (s *DisplayServer) newEtag() string {
+	s.nextRevision++
+	return strconv.FormatInt(s.nextRevision, 10)
+}
+
+// assignmentEtag returns the etag of the sign assignment of a kiosk. Every
+// change to an assignment has a new event id, so it serves as the etag.
+func assignmentEtag(eventID int64) string {
+	return strconv.FormatInt(eventID, 10)
+}
+
+// checkEtag returns an Aborted error if a request has an etag that doesn't
+// match the current etag of a resource.
+func checkEtag(resource string, requested string, current string) error {
+	if requested != "" && requested != current {
+		return status.Errorf(codes.Aborted, "%s has changed: etag is %q, not %q", resource, current, requested)
+	}
+	return nil
+}
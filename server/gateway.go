@@ -0,0 +1,84 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	pb "github.com/googleapis/kiosk/generated"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// jsonMarshaler renders responses with the same print options that
+// envoy/envoy.yaml configures for the Envoy gRPC-JSON transcoder.
+var jsonMarshaler = &runtime.JSONPb{
+	MarshalOptions: protojson.MarshalOptions{
+		Multiline:       true, // add_whitespace
+		Indent:          "  ",
+		EmitUnpopulated: true,  // always_print_primitive_fields
+		UseEnumNumbers:  false, // always_print_enums_as_ints
+		UseProtoNames:   false, // preserve_proto_field_names
+	},
+	UnmarshalOptions: protojson.UnmarshalOptions{
+		DiscardUnknown: true,
+	},
+}
+
+// NewGateway returns an HTTP handler that serves the google.api.http
+// mappings declared in kiosk.proto. Requests are transcoded and forwarded
+// to the gRPC server at grpcAddress so that they are handled exactly like
+// native gRPC calls.
+func NewGateway(ctx context.Context, grpcAddress string) (*runtime.ServeMux, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, jsonMarshaler),
+		runtime.WithIncomingHeaderMatcher(func(key string) (string, bool) {
+			if strings.EqualFold(key, requestIDKey) {
+				return requestIDKey, true
+			}
+			return runtime.DefaultHeaderMatcher(key)
+		}),
+		runtime.WithMetadata(func(ctx context.Context, r *http.Request) metadata.MD {
+			return metadata.Pairs(gatewayTokenKey, gatewayToken)
+		}),
+		runtime.WithOutgoingHeaderMatcher(func(key string) (string, bool) {
+			if key == requestIDKey {
+				return "X-Request-Id", true
+			}
+			return runtime.MetadataHeaderPrefix + key, true
+		}),
+	)
+	opts := []grpc.DialOption{
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+	}
+	if useSSL {
+		// The gateway only talks to its own server over loopback.
+		opts = append(opts, grpc.WithTransportCredentials(
+			credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if err := pb.RegisterDisplayHandlerFromEndpoint(ctx, mux, grpcAddress, opts); err != nil {
+		return nil, err
+	}
+	return mux, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// displayService is the name that health checks use for the Display service.
+const displayService = "kiosk.Display"
+
+// Ready reports whether the storage behind the server can serve requests.
+// The in-memory store is ready as long as it can be locked promptly.
+func (s *DisplayServer) Ready(ctx context.Context) error {
+	locked := make(chan struct{})
+	go func() {
+		s.mux.Lock()
+		s.mux.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		return errors.New("storage is not responding")
+	}
+}
+
+// reportHealth sets the serving status of the Display service from the
+// readiness of its storage every interval, until ctx is done.
+func reportHealth(ctx context.Context, healthServer *health.Server, s *DisplayServer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		status := healthpb.HealthCheckResponse_SERVING
+		if err := s.Ready(checkCtx); err != nil {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		healthServer.SetServingStatus("", status)
+		healthServer.SetServingStatus(displayService, status)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
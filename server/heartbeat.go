@@ -0,0 +1,106 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// A kioskStatus is what the server knows about whether a kiosk is on.
+// It is kept apart from the kiosk so that heartbeats don't change its etag.
+type kioskStatus struct {
+	lastSeen            time.Time
+	displayedSignID     int32
+	displayedRevisionID int32
+}
+
+// seen records that a kiosk was on at a time. It must be called with s.mux
+// held.
+func (s *DisplayServer) seen(kioskID int32, now time.Time) *kioskStatus {
+	st := s.statuses[kioskID]
+	if st == nil {
+		st = &kioskStatus{}
+		s.statuses[kioskID] = st
+	}
+	st.lastSeen = now
+	return st
+}
+
+// connectionState returns whether a kiosk is connected, online or offline
+// and when it was last seen. It must be called with s.mux held.
+func (s *DisplayServer) connectionState(kioskID int32, now time.Time) (pb.Kiosk_ConnectionState, time.Time) {
+	if len(s.subscribers[kioskID]) > 0 {
+		return pb.Kiosk_CONNECTED, now
+	}
+	st := s.statuses[kioskID]
+	if st == nil {
+		return pb.Kiosk_OFFLINE, time.Time{}
+	}
+	if now.Sub(st.lastSeen) < s.HeartbeatTimeout {
+		return pb.Kiosk_ONLINE, st.lastSeen
+	}
+	return pb.Kiosk_OFFLINE, st.lastSeen
+}
+
+// withStatus returns a copy of a kiosk with its connection state and what
+// it is displaying. It must be called with s.mux held.
+func (s *DisplayServer) withStatus(kiosk *pb.Kiosk, now time.Time) *pb.Kiosk {
+	kiosk = proto.Clone(kiosk).(*pb.Kiosk)
+	state, lastSeen := s.connectionState(kiosk.Id, now)
+	kiosk.ConnectionState = state
+	if !lastSeen.IsZero() {
+		kiosk.LastSeenTime = timestamppb.New(lastSeen)
+	}
+	if st := s.statuses[kiosk.Id]; st != nil {
+		kiosk.DisplayedSignId = st.displayedSignID
+		kiosk.DisplayedRevisionId = st.displayedRevisionID
+	}
+	return kiosk
+}
+
+// offlineSince returns true if a kiosk has been offline since before a time.
+// Kiosks that have never been seen have always been offline. It must be
+// called with s.mux held.
+func (s *DisplayServer) offlineSince(kioskID int32, now time.Time, since time.Time) bool {
+	state, lastSeen := s.connectionState(kioskID, now)
+	return state == pb.Kiosk_OFFLINE && lastSeen.Before(since)
+}
+
+// ReportKioskStatus records a heartbeat from a kiosk with the sign that it
+// is displaying.
+func (s *DisplayServer) ReportKioskStatus(c context.Context, r *pb.ReportKioskStatusRequest) (*google_protobuf.Empty, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeKiosk(r.KioskId) == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	s.reportStatus(r.KioskId, r)
+	return &google_protobuf.Empty{}, nil
+}
+
+// reportStatus records a heartbeat from a kiosk with the sign that it is
+// displaying. It must be called with s.mux held.
+func (s *DisplayServer) reportStatus(kioskID int32, r *pb.ReportKioskStatusRequest) {
+	st := s.seen(kioskID, time.Now())
+	st.displayedSignID = r.DisplayedSignId
+	st.displayedRevisionID = r.DisplayedRevisionId
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"time"
+
+	pb "github.com/googleapis/kiosk/generated"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// A createRecord remembers the result of a create request so that retries
+// of the request can return it.
+type createRecord struct {
+	key     string
+	hash    [sha256.Size]byte
+	result  proto.Message
+	expires time.Time
+}
+
+// requestHash summarizes the payload of a create request. The request id and
+// output-only fields are cleared by clear before hashing, so that retries of
+// a request hash the same way.
+func requestHash(m proto.Message, clear func(proto.Message)) [sha256.Size]byte {
+	m = proto.Clone(m)
+	clear(m)
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	return sha256.Sum256(b)
+}
+
+// lookupRequest returns the result of an earlier request to method with the
+// same request id, or nil if there wasn't one or the resource that it
+// created has been deleted since. It returns an error if the earlier request
+// had a different payload. It must be called with s.mux held.
+func (s *DisplayServer) lookupRequest(method string, requestID string, hash [sha256.Size]byte) (proto.Message, error) {
+	now := time.Now()
+	for len(s.createRecords) > 0 && now.After(s.createRecords[0].expires) {
+		if key := s.createRecords[0].key; s.requestIds[key] == s.createRecords[0] {
+			delete(s.requestIds, key)
+		}
+		s.createRecords = s.createRecords[1:]
+	}
+	record := s.requestIds[method+"/"+requestID]
+	if record == nil {
+		return nil, nil
+	}
+	if !s.created(record.result) {
+		delete(s.requestIds, record.key)
+		return nil, nil
+	}
+	if record.hash != hash {
+		return nil, status.Errorf(codes.InvalidArgument, "request_id %q was already used for a different %s request", requestID, method)
+	}
+	return proto.Clone(record.result), nil
+}
+
+// created returns true if the resource that a create request returned hasn't
+// been deleted. It must be called with s.mux held.
+func (s *DisplayServer) created(result proto.Message) bool {
+	switch r := result.(type) {
+	case *pb.Kiosk:
+		return s.activeKiosk(r.Id) != nil
+	case *pb.Sign:
+		return s.activeSign(r.Id) != nil
+	}
+	return true
+}
+
+// rememberRequest records the result of a request to method so that retries
+// with the same request id return it. It must be called with s.mux held.
+func (s *DisplayServer) rememberRequest(method string, requestID string, hash [sha256.Size]byte, result proto.Message) {
+	if s.RequestRetention <= 0 {
+		return
+	}
+	record := &createRecord{
+		key:     method + "/" + requestID,
+		hash:    hash,
+		result:  proto.Clone(result),
+		expires: time.Now().Add(s.RequestRetention),
+	}
+	s.requestIds[record.key] = record
+	s.createRecords = append(s.createRecords, record)
+}
@@ -15,60 +15,412 @@
 package main
 
 import (
+	"crypto/sha256"
 	"errors"
-	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
 	google_protobuf "github.com/golang/protobuf/ptypes/empty"
 	pb "github.com/googleapis/kiosk/generated"
+	"go.opentelemetry.io/otel/attribute"
 	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
+// A signUpdate notifies a subscriber that the sign for a kiosk has changed,
+// or carries a command for the kiosk.
+type signUpdate struct {
+	signID     int32
+	revisionID int32            // pinned revision, or 0 for the latest
+	eventID    int64            // increases with every change, used to resume watches
+	etagID     int64            // event id of the last change to the assignment, its etag
+	published  time.Time        // when the change was made
+	layoutID   int32            // layout of the kiosk, or 0 for none
+	region     string           // region of the layout, or empty for the kiosk's sign
+	command    *pb.KioskCommand // a command for the kiosk instead of a sign
+}
+
+// A subscription records which updates a subscriber wants besides the
+// kiosk's own sign.
+type subscription struct {
+	regions  bool // the signs of the regions of the kiosk's layout
+	commands bool // commands for the kiosk
+}
+
+// wants returns true if a subscription includes an update.
+func (sub subscription) wants(update signUpdate) bool {
+	if update.command != nil {
+		return sub.commands
+	}
+	return update.region == "" || sub.regions
+}
+
+// response returns the message that tells a kiosk about an update.
+func (u signUpdate) response() *pb.GetSignIdResponse {
+	if u.command != nil {
+		return &pb.GetSignIdResponse{Command: u.command}
+	}
+	return &pb.GetSignIdResponse{
+		SignId:     u.signID,
+		Etag:       assignmentEtag(u.etagID),
+		RevisionId: u.revisionID,
+		LayoutId:   u.layoutID,
+		Region:     u.region,
+	}
+}
+
 // DisplayServer manages a collection of kiosks.
 type DisplayServer struct {
-	SessionLifetime    time.Duration
-	kiosks             map[int32]*pb.Kiosk
-	signs              map[int32]*pb.Sign
-	signIdsForKioskIds map[int32]int32
-	subscribers        map[int32]map[chan int32]bool
-	nextKioskId        int32
-	nextSignId         int32
-	mux                sync.Mutex
+	SessionLifetime        time.Duration
+	AuditLog               *AuditLog // records mutations if not nil
+	Quotas                 Quotas
+	RequestRetention       time.Duration // how long create request ids and play event ids are remembered
+	DeleteRetention        time.Duration // how long deleted kiosks and signs are kept
+	HeartbeatTimeout       time.Duration // how long a kiosk is online after a heartbeat
+	ScreenshotInterval     time.Duration // how often kiosks upload screenshots, or 0
+	ScreenshotsPerKiosk    int           // how many screenshots are kept for each kiosk
+	kiosks                 map[int32]*pb.Kiosk
+	signs                  map[int32]*pb.Sign
+	signIdsForKioskIds     map[int32]int32
+	revisionIdsForKioskIds map[int32]int32
+	eventIdsForKioskIds    map[int32]int64 // last update of each kiosk's sign
+	etagIdsForKioskIds     map[int32]int64 // last change to each kiosk's assignment
+	subscribers            map[int32]map[chan signUpdate]subscription
+	sessions               map[int32]map[chan *pb.KioskSessionResponse]bool
+	statuses               map[int32]*kioskStatus
+	plays                  map[playKey]*playTotals
+	playEventIds           map[int32]map[string]time.Time // by kiosk, when each id expires
+	nextKioskId            int32
+	nextSignId             int32
+	nextEventId            int64
+	nextRevision           int64                   // last kiosk or sign etag
+	images                 map[string]*storedImage // by hash
+	imageBytes             int64                   // total size of images
+	revisions              map[int32][]*pb.SignRevision
+	requestIds             map[string]*createRecord
+	createRecords          []*createRecord // oldest first
+	rollouts               map[int32]*rollout
+	nextRolloutId          int32
+	commands               map[int32][]*pb.KioskCommand // by kiosk id, oldest first
+	nextCommandId          int32
+	screenshots            map[int32][]*pb.Screenshot // by kiosk id, oldest first, without images
+	nextScreenshotId       int32
+	overrides              map[int32]*override
+	overridesForKioskIds   map[int32]*override // active overrides by kiosk id
+	nextOverrideId         int32
+	templates              map[int32]*pb.SignTemplate
+	nextTemplateId         int32
+	variablesForKioskIds   map[int32]map[int32]map[string]string // by kiosk id, then sign id
+	data                   map[string]*pb.DataValue              // the data feed, by key
+	layouts                map[int32]*pb.Layout
+	nextLayoutId           int32
+	layoutsForKioskIds     map[int32]*kioskLayout
+	draining               chan struct{}
+	drainOnce              sync.Once
+	mux                    sync.Mutex
 }
 
 // NewDisplayServer creates and returns a new DisplayServer.
 func NewDisplayServer() *DisplayServer {
 	return &DisplayServer{
-		SessionLifetime:    24 * time.Hour,
-		kiosks:             make(map[int32]*pb.Kiosk),
-		signs:              make(map[int32]*pb.Sign),
-		signIdsForKioskIds: make(map[int32]int32),
-		subscribers:        make(map[int32]map[chan int32]bool),
-		nextKioskId:        1,
-		nextSignId:         1,
+		SessionLifetime:        24 * time.Hour,
+		RequestRetention:       time.Hour,
+		DeleteRetention:        7 * 24 * time.Hour,
+		HeartbeatTimeout:       2 * time.Minute,
+		ScreenshotsPerKiosk:    5,
+		kiosks:                 make(map[int32]*pb.Kiosk),
+		signs:                  make(map[int32]*pb.Sign),
+		signIdsForKioskIds:     make(map[int32]int32),
+		revisionIdsForKioskIds: make(map[int32]int32),
+		eventIdsForKioskIds:    make(map[int32]int64),
+		etagIdsForKioskIds:     make(map[int32]int64),
+		subscribers:            make(map[int32]map[chan signUpdate]subscription),
+		sessions:               make(map[int32]map[chan *pb.KioskSessionResponse]bool),
+		statuses:               make(map[int32]*kioskStatus),
+		plays:                  make(map[playKey]*playTotals),
+		playEventIds:           make(map[int32]map[string]time.Time),
+		requestIds:             make(map[string]*createRecord),
+		images:                 make(map[string]*storedImage),
+		revisions:              make(map[int32][]*pb.SignRevision),
+		rollouts:               make(map[int32]*rollout),
+		commands:               make(map[int32][]*pb.KioskCommand),
+		screenshots:            make(map[int32][]*pb.Screenshot),
+		overrides:              make(map[int32]*override),
+		overridesForKioskIds:   make(map[int32]*override),
+		templates:              make(map[int32]*pb.SignTemplate),
+		variablesForKioskIds:   make(map[int32]map[int32]map[string]string),
+		data:                   make(map[string]*pb.DataValue),
+		layouts:                make(map[int32]*pb.Layout),
+		layoutsForKioskIds:     make(map[int32]*kioskLayout),
+		nextKioskId:            1,
+		nextSignId:             1,
+		nextEventId:            1,
+		nextRolloutId:          1,
+		nextCommandId:          1,
+		nextScreenshotId:       1,
+		nextOverrideId:         1,
+		nextTemplateId:         1,
+		nextLayoutId:           1,
+		draining:               make(chan struct{}),
+	}
+}
+
+// errDraining is returned to streaming clients when the server shuts down.
+var errDraining = status.Error(codes.Unavailable, "server is shutting down, please reconnect")
+
+// Drain ends all streams that watch for sign changes so that their clients
+// reconnect, presumably to another server. New streams end immediately.
+func (s *DisplayServer) Drain() {
+	s.drainOnce.Do(func() {
+		close(s.draining)
+	})
+}
+
+// subscriberBuffer is how many sign changes may wait to be sent to a
+// subscriber before it is caught up with only the latest ones.
+const subscriberBuffer = 64
+
+// subscribe registers a channel that receives sign changes for a kiosk,
+// and the other updates that sub asks for. The kiosk is connected until the
+// channel is unsubscribed. It must be called with s.mux held.
+func (s *DisplayServer) subscribe(kioskID int32, sub subscription) chan signUpdate {
+	ch := make(chan signUpdate, subscriberBuffer)
+	if s.subscribers[kioskID] == nil {
+		s.subscribers[kioskID] = make(map[chan signUpdate]subscription)
+	}
+	s.subscribers[kioskID][ch] = sub
+	s.seen(kioskID, time.Now())
+	return ch
+}
+
+// unsubscribe removes a channel registered with subscribe. It acquires s.mux
+// itself.
+func (s *DisplayServer) unsubscribe(kioskID int32, ch chan signUpdate) {
+	s.mux.Lock()
+	delete(s.subscribers[kioskID], ch)
+	s.seen(kioskID, time.Now())
+	s.mux.Unlock()
+}
+
+// setSignIdForKioskId assigns a sign to a kiosk and returns the update to
+// send to its subscribers. It must be called with s.mux held.
+func (s *DisplayServer) setSignIdForKioskId(kioskID int32, signID int32, revisionID int32) signUpdate {
+	s.signIdsForKioskIds[kioskID] = signID
+	s.revisionIdsForKioskIds[kioskID] = revisionID
+	s.etagIdsForKioskIds[kioskID] = s.nextEventId
+	return s.resendSignId(kioskID)
+}
+
+// resendSignId returns an update with a new event id that sends the
+// assignment of a kiosk to its subscribers again, without changing its
+// etag. It must be called with s.mux held.
+func (s *DisplayServer) resendSignId(kioskID int32) signUpdate {
+	s.eventIdsForKioskIds[kioskID] = s.nextEventId
+	update := signUpdate{
+		signID:     s.signIdsForKioskIds[kioskID],
+		revisionID: s.revisionIdsForKioskIds[kioskID],
+		eventID:    s.nextEventId,
+		etagID:     s.etagIdsForKioskIds[kioskID],
+		published:  time.Now(),
+		layoutID:   s.layoutId(kioskID),
+	}
+	s.nextEventId++
+	return update
+}
+
+// notify sends an update to the subscribers of a kiosk that want it
+// without blocking. A subscriber whose buffer is full has its waiting
+// updates replaced by the current ones, so the latest changes win. It
+// returns the number of subscribers notified and must be called with s.mux
+// held.
+func (s *DisplayServer) notify(kioskID int32, update signUpdate) int {
+	notified := 0
+	for c, sub := range s.subscribers[kioskID] {
+		if !sub.wants(update) {
+			continue
+		}
+		select {
+		case c <- update:
+		default:
+			s.catchUp(kioskID, c, sub, update.published)
+		}
+		notified++
+	}
+	return notified
+}
+
+// currentUpdates returns the current sign of a kiosk and the other updates
+// that sub asks for: the signs of the regions of its layout and its queued
+// commands. It must be called with s.mux held.
+func (s *DisplayServer) currentUpdates(kioskID int32, sub subscription) []signUpdate {
+	updates := []signUpdate{s.currentUpdate(kioskID)}
+	if sub.regions {
+		updates = append(updates, s.regionUpdates(kioskID)...)
+	}
+	if sub.commands {
+		for _, command := range s.queuedCommands(kioskID) {
+			updates = append(updates, signUpdate{command: command, published: time.Now()})
+		}
+	}
+	return updates
+}
+
+// catchUp drops the updates waiting for a subscriber that fell behind and
+// sends it the current ones instead. It must be called with s.mux held.
+func (s *DisplayServer) catchUp(kioskID int32, c chan signUpdate, sub subscription, published time.Time) {
+	for len(c) > 0 {
+		select {
+		case <-c:
+		default:
+		}
 	}
+	for _, update := range s.currentUpdates(kioskID, sub) {
+		update.published = published
+		select {
+		case c <- update:
+		default:
+		}
+	}
+}
+
+// currentUpdate returns the current sign assignment of a kiosk as an
+// update. It must be called with s.mux held.
+func (s *DisplayServer) currentUpdate(kioskID int32) signUpdate {
+	return signUpdate{
+		signID:     s.signIdsForKioskIds[kioskID],
+		revisionID: s.revisionIdsForKioskIds[kioskID],
+		eventID:    s.eventIdsForKioskIds[kioskID],
+		etagID:     s.etagIdsForKioskIds[kioskID],
+		layoutID:   s.layoutId(kioskID),
+	}
+}
+
+// signIdResponse returns the sign assignment of a kiosk. It must be called
+// with s.mux held.
+func (s *DisplayServer) signIdResponse(kioskID int32) *pb.GetSignIdResponse {
+	return &pb.GetSignIdResponse{
+		SignId:     s.signIdsForKioskIds[kioskID],
+		Etag:       assignmentEtag(s.etagIdsForKioskIds[kioskID]),
+		RevisionId: s.revisionIdsForKioskIds[kioskID],
+		LayoutId:   s.layoutId(kioskID),
+	}
+}
+
+// activeKiosk returns the kiosk with an id, or nil if there is none or it
+// has been deleted. It must be called with s.mux held.
+func (s *DisplayServer) activeKiosk(id int32) *pb.Kiosk {
+	if k := s.kiosks[id]; k != nil && k.DeleteTime == nil {
+		return k
+	}
+	return nil
+}
+
+// activeSign returns the sign with an id, or nil if there is none or it has
+// been deleted. It must be called with s.mux held.
+func (s *DisplayServer) activeSign(id int32) *pb.Sign {
+	if sign := s.signs[id]; sign != nil && sign.DeleteTime == nil {
+		return sign
+	}
+	return nil
+}
+
+// activeKiosks returns the number of kiosks that haven't been deleted, which
+// count against the kiosk quota. It must be called with s.mux held.
+func (s *DisplayServer) activeKiosks() int {
+	n := 0
+	for _, k := range s.kiosks {
+		if k.DeleteTime == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// activeSigns returns the number of signs that haven't been deleted, which
+// count against the sign quota. It must be called with s.mux held.
+func (s *DisplayServer) activeSigns() int {
+	n := 0
+	for _, sign := range s.signs {
+		if sign.DeleteTime == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// kioskRequestHash summarizes a request to create a kiosk.
+func kioskRequestHash(kiosk *pb.Kiosk) [sha256.Size]byte {
+	return requestHash(kiosk, func(m proto.Message) {
+		k := m.(*pb.Kiosk)
+		k.Id, k.CreateTime, k.RequestId, k.Etag = 0, nil, "", ""
+	})
 }
 
 // CreateKiosk creates and enrolls a kiosk for sign display.
 func (s *DisplayServer) CreateKiosk(c context.Context, kiosk *pb.Kiosk) (*pb.Kiosk, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
+	return s.createKiosk(c, "CreateKiosk", kiosk)
+}
+
+// createKiosk creates a kiosk for a request to method. It must be called
+// with s.mux held.
+func (s *DisplayServer) createKiosk(c context.Context, method string, kiosk *pb.Kiosk) (*pb.Kiosk, error) {
+	hash := kioskRequestHash(kiosk)
+	if kiosk.RequestId != "" {
+		result, err := s.lookupRequest("CreateKiosk", kiosk.RequestId, hash)
+		if err != nil {
+			return nil, err
+		} else if result != nil {
+			return result.(*pb.Kiosk), nil
+		}
+	}
+	if err := checkVariables(kiosk.Variables); err != nil {
+		return nil, err
+	}
+	if max := s.Quotas.MaxKiosks; max > 0 && s.activeKiosks() >= max {
+		return nil, resourceExhausted(quotaRetryDelay, "there are already %d kiosks", max)
+	}
+	requestID := kiosk.RequestId
+	kiosk.RequestId = ""
 	kiosk.Id = s.nextKioskId
+	kiosk.Etag = s.newEtag()
+	kiosk.DeleteTime, kiosk.ExpireTime = nil, nil
 	s.kiosks[kiosk.Id] = kiosk
 	s.nextKioskId++
+	if requestID != "" {
+		s.rememberRequest("CreateKiosk", requestID, hash, kiosk)
+	}
+	s.audit(c, method, kioskName(kiosk.Id), kiosk, nil, kiosk)
+	s.applyOverrides(c, method, kiosk, kiosk.Id)
 	return kiosk, nil
 }
 
-// ListKiosks returns a list of active kiosks.
-func (s *DisplayServer) ListKiosks(c context.Context, x *google_protobuf.Empty) (*pb.ListKiosksResponse, error) {
+// ListKiosks returns a list of active kiosks, and deleted ones if
+// r.ShowDeleted is set. If r.OfflineSince is set, only kiosks that have
+// been offline for that long are listed.
+func (s *DisplayServer) ListKiosks(c context.Context, r *pb.ListKiosksRequest) (*pb.ListKiosksResponse, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
+	if r.OfflineSince != nil {
+		if err := r.OfflineSince.CheckValid(); err != nil || r.OfflineSince.AsDuration() < 0 {
+			return nil, status.Error(codes.InvalidArgument, "invalid offline_since")
+		}
+	}
+	now := time.Now()
+	since := now.Add(-r.OfflineSince.AsDuration())
 	response := &pb.ListKiosksResponse{}
 	for _, k := range s.kiosks {
-		if k != nil {
-			response.Kiosks = append(response.Kiosks, k)
+		if k == nil || (k.DeleteTime != nil && !r.ShowDeleted) {
+			continue
+		}
+		if r.OfflineSince != nil && !s.offlineSince(k.Id, now, since) {
+			continue
 		}
+		response.Kiosks = append(response.Kiosks, s.withStatus(k, now))
 	}
 	return response, nil
 }
@@ -79,45 +431,160 @@ func (s *DisplayServer) GetKiosk(c context.Context, r *pb.GetKioskRequest) (*pb.
 	defer s.mux.Unlock()
 	i := r.Id
 	if s.kiosks[i] != nil {
-		return s.kiosks[i], nil
+		return s.withStatus(s.kiosks[i], time.Now()), nil
 	} else {
 		return nil, errors.New("invalid kiosk id")
 	}
 }
 
-// DeleteKiosk deletes the kiosk with ID r.Id.
+// UpdateKiosk replaces the kiosk with ID kiosk.Id.
+func (s *DisplayServer) UpdateKiosk(c context.Context, kiosk *pb.Kiosk) (*pb.Kiosk, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	old := s.activeKiosk(kiosk.Id)
+	if old == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	if err := checkEtag(kioskName(kiosk.Id), kiosk.Etag, old.Etag); err != nil {
+		return nil, err
+	}
+	if err := checkVariables(kiosk.Variables); err != nil {
+		return nil, err
+	}
+	// Replace the kiosk instead of changing it, because earlier responses
+	// may still be in use.
+	updated := &pb.Kiosk{
+		Id:         old.Id,
+		Name:       kiosk.Name,
+		Size:       kiosk.Size,
+		Location:   kiosk.Location,
+		CreateTime: old.CreateTime,
+		Etag:       s.newEtag(),
+		Variables:  kiosk.Variables,
+	}
+	s.kiosks[kiosk.Id] = updated
+	s.audit(c, "UpdateKiosk", kioskName(kiosk.Id), kiosk, old, updated)
+	s.sendToSessions(kiosk.Id, s.kioskConfig(kiosk.Id))
+	if sign := s.signs[s.signIdsForKioskIds[kiosk.Id]]; sign != nil && sign.TemplateId != 0 &&
+		!sameVariables(old.Variables, updated.Variables) {
+		s.refreshKiosks([]int32{kiosk.Id})
+	}
+	return s.withStatus(updated, time.Now()), nil
+}
+
+// DeleteKiosk deletes the kiosk with ID r.Id. The kiosk is kept until
+// s.DeleteRetention has passed so that it can be undeleted.
 func (s *DisplayServer) DeleteKiosk(c context.Context, r *pb.DeleteKioskRequest) (*google_protobuf.Empty, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	i := r.Id
-	if s.kiosks[i] != nil {
-		delete(s.kiosks, i)
-		if len(s.kiosks) == 0 {
-			s.nextKioskId = 1
+	if err := s.deleteKiosk(c, "DeleteKiosk", r, r.Id, r.Etag); err != nil {
+		return nil, err
+	}
+	return &google_protobuf.Empty{}, nil
+}
+
+// deleteKiosk deletes a kiosk for request r to method. It must be called
+// with s.mux held.
+func (s *DisplayServer) deleteKiosk(c context.Context, method string, r proto.Message, i int32, etag string) error {
+	if k := s.activeKiosk(i); k != nil {
+		if err := checkEtag(kioskName(i), etag, k.Etag); err != nil {
+			return err
 		}
-		return &google_protobuf.Empty{}, nil
+		deleted := proto.Clone(k).(*pb.Kiosk)
+		deleted.DeleteTime, deleted.ExpireTime = s.deleteTimes()
+		deleted.Etag = s.newEtag()
+		s.kiosks[i] = deleted
+		s.audit(c, method, kioskName(i), r, k, deleted)
+		return nil
 	} else {
+		return errors.New("invalid kiosk id")
+	}
+}
+
+// UndeleteKiosk restores the deleted kiosk with ID r.Id.
+func (s *DisplayServer) UndeleteKiosk(c context.Context, r *pb.UndeleteKioskRequest) (*pb.Kiosk, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	i := r.Id
+	k := s.kiosks[i]
+	if k == nil {
 		return nil, errors.New("invalid kiosk id")
 	}
+	if k.DeleteTime == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "kiosk %d is not deleted", i)
+	}
+	if max := s.Quotas.MaxKiosks; max > 0 && s.activeKiosks() >= max {
+		return nil, resourceExhausted(quotaRetryDelay, "there are already %d kiosks", max)
+	}
+	restored := proto.Clone(k).(*pb.Kiosk)
+	restored.DeleteTime, restored.ExpireTime = nil, nil
+	restored.Etag = s.newEtag()
+	s.kiosks[i] = restored
+	s.audit(c, "UndeleteKiosk", kioskName(i), r, k, restored)
+	s.applyOverrides(c, "UndeleteKiosk", r, i)
+	s.sendToSessions(i, s.kioskConfig(i))
+	return s.withStatus(restored, time.Now()), nil
+}
+
+// signRequestHash summarizes a request to create a sign.
+func signRequestHash(sign *pb.Sign) [sha256.Size]byte {
+	return requestHash(sign, func(m proto.Message) {
+		sign := m.(*pb.Sign)
+		sign.Id, sign.CreateTime, sign.RequestId, sign.Etag = 0, nil, "", ""
+	})
 }
 
 // CreateSign creates and enrolls a sign for sign display.
 func (s *DisplayServer) CreateSign(c context.Context, sign *pb.Sign) (*pb.Sign, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
+	return s.createSign(c, "CreateSign", sign)
+}
+
+// createSign creates a sign for a request to method. It must be called with
+// s.mux held.
+func (s *DisplayServer) createSign(c context.Context, method string, sign *pb.Sign) (*pb.Sign, error) {
+	hash := signRequestHash(sign)
+	if sign.RequestId != "" {
+		result, err := s.lookupRequest("CreateSign", sign.RequestId, hash)
+		if err != nil {
+			return nil, err
+		} else if result != nil {
+			return result.(*pb.Sign), nil
+		}
+	}
+	if err := s.checkSignTemplate(sign); err != nil {
+		return nil, err
+	}
+	if max := s.Quotas.MaxSigns; max > 0 && s.activeSigns() >= max {
+		return nil, resourceExhausted(quotaRetryDelay, "there are already %d signs", max)
+	}
+	if err := s.checkImageQuota(sign.Image); err != nil {
+		return nil, err
+	}
+	requestID := sign.RequestId
+	sign.RequestId = ""
 	sign.Id = s.nextSignId
+	sign.Etag = s.newEtag()
+	sign.DeleteTime, sign.ExpireTime = nil, nil
+	s.addRevision(c, sign)
 	s.signs[sign.Id] = sign
 	s.nextSignId++
+	if requestID != "" {
+		s.rememberRequest("CreateSign", requestID, hash, sign)
+	}
+	s.audit(c, method, signName(sign.Id), sign, nil, sign)
 	return sign, nil
 }
 
-// ListSigns returns a list of active signs.
-func (s *DisplayServer) ListSigns(c context.Context, x *google_protobuf.Empty) (*pb.ListSignsResponse, error) {
+// ListSigns returns a list of active signs, and deleted ones if
+// r.ShowDeleted is set.
+func (s *DisplayServer) ListSigns(c context.Context, r *pb.ListSignsRequest) (*pb.ListSignsResponse, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	response := &pb.ListSignsResponse{}
 	for _, k := range s.signs {
-		if k != nil {
+		if k != nil && (k.DeleteTime == nil || r.ShowDeleted) {
 			response.Signs = append(response.Signs, k)
 		}
 	}
@@ -135,45 +602,214 @@ func (s *DisplayServer) GetSign(c context.Context, r *pb.GetSignRequest) (*pb.Si
 	return nil, errors.New("invalid sign id")
 }
 
-// DeleteSign deletes the sign with ID r.Id.
+// UpdateSign replaces the sign with ID sign.Id.
+func (s *DisplayServer) UpdateSign(c context.Context, sign *pb.Sign) (*pb.Sign, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	old := s.activeSign(sign.Id)
+	if old == nil {
+		return nil, errors.New("invalid sign id")
+	}
+	if err := checkEtag(signName(sign.Id), sign.Etag, old.Etag); err != nil {
+		return nil, err
+	}
+	if err := s.checkSignTemplate(sign); err != nil {
+		return nil, err
+	}
+	if err := s.checkImageQuota(sign.Image); err != nil {
+		return nil, err
+	}
+	updated := &pb.Sign{
+		Id:         old.Id,
+		Name:       sign.Name,
+		Text:       sign.Text,
+		Image:      sign.Image,
+		CreateTime: old.CreateTime,
+		Etag:       s.newEtag(),
+		RevisionId: old.RevisionId,
+		ImageHash:  old.ImageHash,
+		TemplateId: sign.TemplateId,
+	}
+	if updated.Text != old.Text || imageHash(updated.Image) != old.ImageHash {
+		s.addRevision(c, updated)
+	}
+	s.signs[sign.Id] = updated
+	s.audit(c, "UpdateSign", signName(sign.Id), sign, old, updated)
+	if updated.RevisionId != old.RevisionId {
+		s.signChanged(updated)
+	}
+	if updated.TemplateId != old.TemplateId {
+		s.refreshKiosks(s.kiosksShowing(func(shown *pb.Sign) bool {
+			return shown.Id == updated.Id
+		}))
+	}
+	return updated, nil
+}
+
+// DeleteSign deletes the sign with ID r.Id. The sign is kept until
+// s.DeleteRetention has passed so that it can be undeleted.
 func (s *DisplayServer) DeleteSign(c context.Context, r *pb.DeleteSignRequest) (*google_protobuf.Empty, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := s.deleteSign(c, "DeleteSign", r, r.Id, r.Etag); err != nil {
+		return nil, err
+	}
+	return &google_protobuf.Empty{}, nil
+}
+
+// deleteSign deletes a sign for request r to method. It must be called with
+// s.mux held.
+func (s *DisplayServer) deleteSign(c context.Context, method string, r proto.Message, i int32, etag string) error {
+	if sign := s.activeSign(i); sign != nil {
+		if err := checkEtag(signName(i), etag, sign.Etag); err != nil {
+			return err
+		}
+		deleted := proto.Clone(sign).(*pb.Sign)
+		deleted.DeleteTime, deleted.ExpireTime = s.deleteTimes()
+		deleted.Etag = s.newEtag()
+		s.signs[i] = deleted
+		s.audit(c, method, signName(i), r, sign, deleted)
+		return nil
+	}
+	return errors.New("invalid sign id")
+}
+
+// UndeleteSign restores the deleted sign with ID r.Id.
+func (s *DisplayServer) UndeleteSign(c context.Context, r *pb.UndeleteSignRequest) (*pb.Sign, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	i := r.Id
-	if s.signs[i] != nil {
-		delete(s.signs, i)
-		if len(s.signs) == 0 {
-			s.nextSignId = 1
+	sign := s.signs[i]
+	if sign == nil {
+		return nil, errors.New("invalid sign id")
+	}
+	if sign.DeleteTime == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "sign %d is not deleted", i)
+	}
+	if max := s.Quotas.MaxSigns; max > 0 && s.activeSigns() >= max {
+		return nil, resourceExhausted(quotaRetryDelay, "there are already %d signs", max)
+	}
+	if max := s.Quotas.MaxImageBytes; max > 0 {
+		uncounted := s.uncountedImages()
+		imageBytes := s.countedImageBytes(uncounted)
+		for _, revision := range s.revisions[i] {
+			if uncounted[revision.ImageHash] {
+				imageBytes += int64(len(s.images[revision.ImageHash].data))
+				delete(uncounted, revision.ImageHash)
+			}
+		}
+		if imageBytes > max {
+			return nil, resourceExhausted(quotaRetryDelay, "images would exceed %d bytes", max)
 		}
-		return &google_protobuf.Empty{}, nil
 	}
-	return nil, errors.New("invalid sign id")
+	restored := proto.Clone(sign).(*pb.Sign)
+	restored.DeleteTime, restored.ExpireTime = nil, nil
+	restored.Etag = s.newEtag()
+	s.signs[i] = restored
+	s.audit(c, "UndeleteSign", signName(i), r, sign, restored)
+	return restored, nil
 }
 
-// SetSignIdForKioskIds sets a sign for display on one or more kiosks.
-func (s *DisplayServer) SetSignIdForKioskIds(c context.Context, r *pb.SetSignIdForKioskIdsRequest) (*google_protobuf.Empty, error) {
+// SetSignIdForKioskIds sets a sign for display on one or more kiosks. The
+// whole request is checked before any kiosk is changed, and subscribers are
+// only notified once all of the kiosks have been changed.
+func (s *DisplayServer) SetSignIdForKioskIds(c context.Context, r *pb.SetSignIdForKioskIdsRequest) (*pb.SetSignIdForKioskIdsResponse, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
+	if r.SignId != 0 && s.activeSign(r.SignId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sign id %d", r.SignId)
+	}
+	if r.RevisionId != 0 && s.revision(r.SignId, r.RevisionId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "sign %d has no revision %d", r.SignId, r.RevisionId)
+	}
+	if err := checkVariables(r.Variables); err != nil {
+		return nil, err
+	}
+	kioskIDs := []int32{}
+	seen := make(map[int32]bool)
 	for _, kioskID := range r.KioskIds {
-		s.signIdsForKioskIds[kioskID] = r.SignId
-		if s.subscribers[kioskID] != nil {
-			for c := range s.subscribers[kioskID] {
-				c <- r.SignId
-			}
+		if s.activeKiosk(kioskID) == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid kiosk id %d", kioskID)
+		}
+		if !seen[kioskID] {
+			kioskIDs = append(kioskIDs, kioskID)
+			seen[kioskID] = true
 		}
 	}
 	if len(r.KioskIds) == 0 {
 		var kioskID int32
 		for kioskID = 1; kioskID < s.nextKioskId; kioskID++ {
-			s.signIdsForKioskIds[kioskID] = r.SignId
-			if s.subscribers[kioskID] != nil {
-				for c := range s.subscribers[kioskID] {
-					c <- r.SignId
-				}
+			if s.activeKiosk(kioskID) != nil {
+				kioskIDs = append(kioskIDs, kioskID)
+				seen[kioskID] = true
 			}
 		}
 	}
-	return &google_protobuf.Empty{}, nil
+	// Check all of the etags first so that a conflict changes nothing.
+	for kioskID, etag := range r.Etags {
+		if !seen[kioskID] {
+			return nil, status.Errorf(codes.InvalidArgument, "etag for kiosk %d, which isn't being changed", kioskID)
+		}
+		current := assignmentEtag(s.etagIdsForKioskIds[kioskID])
+		if err := checkEtag(kioskName(kioskID)+"/sign", etag, current); err != nil {
+			return nil, err
+		}
+	}
+	changed := make(map[int32]bool)
+	if r.SignId != 0 {
+		for _, kioskID := range kioskIDs {
+			changed[kioskID] = s.setAssignmentVariables(kioskID, r.SignId, r.Variables)
+		}
+	}
+	response := s.assignSign(c, "SetSignIdForKioskIds", r, kioskIDs, r.SignId, r.RevisionId)
+	// Kiosks that already showed the sign show it with their new variables.
+	if s.signs[r.SignId].GetTemplateId() != 0 {
+		for _, kioskID := range response.UnchangedKioskIds {
+			if changed[kioskID] {
+				before := s.signIdResponse(kioskID)
+				s.refreshKiosks([]int32{kioskID})
+				s.audit(c, "SetSignIdForKioskIds", kioskName(kioskID)+"/sign", r, before, s.signIdResponse(kioskID))
+			}
+		}
+	}
+	return response, nil
+}
+
+// assignSign sets a sign on kiosks that the caller has checked, then
+// notifies their subscribers. Kiosks that already show the sign are left
+// alone, and kiosks under an emergency override get the sign when the
+// override is cleared. Changes are audited as made by request r to method.
+// It must be called with s.mux held.
+func (s *DisplayServer) assignSign(c context.Context, method string, r proto.Message, kioskIDs []int32, signID int32, revisionID int32) *pb.SetSignIdForKioskIdsResponse {
+	response := &pb.SetSignIdForKioskIdsResponse{}
+	updates := make(map[int32]signUpdate)
+	for _, kioskID := range kioskIDs {
+		if o := s.overridesForKioskIds[kioskID]; o != nil {
+			o.previous[kioskID] = assignment{signID: signID, revisionID: revisionID}
+			response.OverriddenKioskIds = append(response.OverriddenKioskIds, kioskID)
+			continue
+		}
+		if s.signIdsForKioskIds[kioskID] == signID && s.revisionIdsForKioskIds[kioskID] == revisionID {
+			response.UnchangedKioskIds = append(response.UnchangedKioskIds, kioskID)
+			continue
+		}
+		before := s.signIdResponse(kioskID)
+		updates[kioskID] = s.setSignIdForKioskId(kioskID, signID, revisionID)
+		response.ChangedKioskIds = append(response.ChangedKioskIds, kioskID)
+		s.audit(c, method, kioskName(kioskID)+"/sign", r, before, s.signIdResponse(kioskID))
+	}
+	_, span := tracer.Start(c, "fanout")
+	defer span.End()
+	notified := 0
+	for _, kioskID := range response.ChangedKioskIds {
+		notified += s.notify(kioskID, updates[kioskID])
+	}
+	span.SetAttributes(
+		attribute.Int("kiosk.sign_id", int(signID)),
+		attribute.Int("kiosk.kiosks", len(response.ChangedKioskIds)),
+		attribute.Int("kiosk.subscribers", notified),
+	)
+	return response
 }
 
 // GetSignIdForKioskId gets the sign that should be displayed on a kiosk.
@@ -181,34 +817,32 @@ func (s *DisplayServer) GetSignIdForKioskId(c context.Context, r *pb.GetSignIdFo
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	kioskID := r.KioskId
-	if s.kiosks[kioskID] == nil {
+	if s.activeKiosk(kioskID) == nil {
 		return nil, errors.New("invalid kiosk id")
 	}
-	signID := s.signIdsForKioskIds[kioskID]
-	response := &pb.GetSignIdResponse{
-		SignId: signID,
-	}
-	return response, nil
+	return s.signIdResponse(kioskID), nil
 }
 
-// GetSignIdsForKioskId gets the signs that should be displayed on a kiosk. Streams.
+// GetSignIdsForKioskId gets the signs that should be displayed on a kiosk,
+// and those of the regions of its layout if r.IncludeRegions is set. If
+// r.IncludeCommands is set, it also delivers the kiosk's commands. Streams.
 func (s *DisplayServer) GetSignIdsForKioskId(r *pb.GetSignIdForKioskIdRequest, stream pb.Display_GetSignIdsForKioskIdServer) error {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	kioskID := r.KioskId
-	if s.kiosks[kioskID] == nil {
+	if s.activeKiosk(kioskID) == nil {
 		return errors.New("invalid kiosk id")
 	}
-	signID := s.signIdsForKioskIds[kioskID]
-	response := &pb.GetSignIdResponse{
-		SignId: signID,
+	if err := s.checkStreamQuota(kioskID); err != nil {
+		return err
 	}
-	stream.Send(response)
-	ch := make(chan int32)
-	if s.subscribers[kioskID] == nil {
-		s.subscribers[kioskID] = make(map[chan int32]bool)
+	sub := subscription{regions: r.IncludeRegions, commands: r.IncludeCommands}
+	for _, update := range s.currentUpdates(kioskID, sub) {
+		if err := stream.Send(update.response()); err == nil && update.command != nil {
+			s.markDelivered(kioskID, update.command.Id)
+		}
 	}
-	s.subscribers[kioskID][ch] = true
+	ch := s.subscribe(kioskID, sub)
 	s.mux.Unlock() // unlock to wait for sign updates
 	timer := time.NewTimer(s.SessionLifetime)
 	running := true
@@ -217,20 +851,26 @@ func (s *DisplayServer) GetSignIdsForKioskId(r *pb.GetSignIdForKioskIdRequest, s
 		case <-timer.C:
 			running = false
 			break
-		case signID, ok := <-ch:
-			response := &pb.GetSignIdResponse{
-				SignId: signID,
-			}
-			err := stream.Send(response)
+		case <-stream.Context().Done():
+			running = false
+			break
+		case <-s.draining:
+			s.unsubscribe(kioskID, ch)
+			s.mux.Lock() // relock for the deferred unlock
+			return errDraining
+		case update, ok := <-ch:
+			err := stream.Send(update.response())
 			if !ok || err != nil {
-				fmt.Printf("error %+v\n", err)
+				slog.WarnContext(stream.Context(), "failed to send sign", "kiosk_id", kioskID, "error", err)
 				running = false
 				break
 			}
+			s.delivered(kioskID, update.command)
+			observeFanout(update)
 		}
 	}
-	s.mux.Lock() // relock to unsubscribe
-	fmt.Printf("removing subscriber for kiosk %d\n", kioskID)
-	delete(s.subscribers[kioskID], ch)
+	slog.DebugContext(stream.Context(), "removing subscriber", "kiosk_id", kioskID)
+	s.unsubscribe(kioskID, ch)
+	s.mux.Lock() // relock for the deferred unlock
 	return nil
 }
@@ -0,0 +1,316 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// regionTolerance allows for rounding when regions reach the edge of the
+// screen, like 0.8 + 0.2.
+const regionTolerance = 1e-6
+
+// A kioskLayout is the layout of a kiosk and the signs in its regions.
+type kioskLayout struct {
+	layoutID int32
+	signIDs  map[string]int32 // by region name
+	eventIDs map[string]int64 // last update of each region
+}
+
+// layoutName returns the audit resource name of a layout.
+func layoutName(id int32) string {
+	return fmt.Sprintf("layouts/%d", id)
+}
+
+// checkLayout returns an error if the regions of a layout are missing,
+// have duplicate names or aren't on the screen.
+func checkLayout(layout *pb.Layout) error {
+	if len(layout.Regions) == 0 {
+		return status.Error(codes.InvalidArgument, "a layout needs at least one region")
+	}
+	names := make(map[string]bool)
+	for i, region := range layout.Regions {
+		var err error
+		switch {
+		case region.Name == "":
+			err = status.Error(codes.InvalidArgument, "a region needs a name")
+		case names[region.Name]:
+			err = status.Errorf(codes.InvalidArgument, "duplicate region %q", region.Name)
+		case region.X < 0 || region.Y < 0 || region.Width <= 0 || region.Height <= 0 ||
+			float64(region.X)+float64(region.Width) > 1+regionTolerance ||
+			float64(region.Y)+float64(region.Height) > 1+regionTolerance:
+			err = status.Errorf(codes.InvalidArgument, "region %q is not on the screen", region.Name)
+		}
+		if err != nil {
+			return itemError("regions", i, err)
+		}
+		names[region.Name] = true
+	}
+	return nil
+}
+
+// hasRegion returns true if a layout has a region with a name.
+func hasRegion(layout *pb.Layout, name string) bool {
+	for _, region := range layout.Regions {
+		if region.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// layoutId returns the layout of a kiosk, or 0 if it has none. It must be
+// called with s.mux held.
+func (s *DisplayServer) layoutId(kioskID int32) int32 {
+	if kl := s.layoutsForKioskIds[kioskID]; kl != nil {
+		return kl.layoutID
+	}
+	return 0
+}
+
+// regionSignId returns the sign shown in a region of the layout of a
+// kiosk, or 0 if the region shows the kiosk's own sign. Every region shows
+// the kiosk's own sign while it is under an emergency override. It must be
+// called with s.mux held.
+func (s *DisplayServer) regionSignId(kioskID int32, region string) int32 {
+	kl := s.layoutsForKioskIds[kioskID]
+	if kl == nil || s.overridesForKioskIds[kioskID] != nil {
+		return 0
+	}
+	return kl.signIDs[region]
+}
+
+// shownSigns returns the signs that a kiosk shows: its own, then those of
+// the regions of its layout. It must be called with s.mux held.
+func (s *DisplayServer) shownSigns(kioskID int32) []assignment {
+	shown := []assignment{{
+		signID:     s.signIdsForKioskIds[kioskID],
+		revisionID: s.revisionIdsForKioskIds[kioskID],
+	}}
+	if kl := s.layoutsForKioskIds[kioskID]; kl != nil {
+		for _, region := range s.layouts[kl.layoutID].Regions {
+			if signID := s.regionSignId(kioskID, region.Name); signID != 0 {
+				shown = append(shown, assignment{signID: signID})
+			}
+		}
+	}
+	return shown
+}
+
+// regionUpdates returns the current signs of the regions of the layout of
+// a kiosk, in the order of the layout. It must be called with s.mux held.
+func (s *DisplayServer) regionUpdates(kioskID int32) []signUpdate {
+	kl := s.layoutsForKioskIds[kioskID]
+	if kl == nil {
+		return nil
+	}
+	updates := []signUpdate{}
+	for _, region := range s.layouts[kl.layoutID].Regions {
+		updates = append(updates, signUpdate{
+			signID:   s.regionSignId(kioskID, region.Name),
+			eventID:  kl.eventIDs[region.Name],
+			etagID:   kl.eventIDs[region.Name],
+			layoutID: kl.layoutID,
+			region:   region.Name,
+		})
+	}
+	return updates
+}
+
+// sendRegions sends the signs of the regions of the layout of a kiosk to
+// its subscribers, with new etags. It must be called with s.mux held.
+func (s *DisplayServer) sendRegions(kioskID int32) {
+	kl := s.layoutsForKioskIds[kioskID]
+	if kl == nil {
+		return
+	}
+	for _, region := range s.layouts[kl.layoutID].Regions {
+		s.sendRegion(kioskID, region.Name)
+	}
+}
+
+// sendRegion sends the sign of a region of the layout of a kiosk to its
+// subscribers, with a new etag. It must be called with s.mux held.
+func (s *DisplayServer) sendRegion(kioskID int32, region string) {
+	kl := s.layoutsForKioskIds[kioskID]
+	kl.eventIDs[region] = s.nextEventId
+	s.notify(kioskID, signUpdate{
+		signID:    s.regionSignId(kioskID, region),
+		eventID:   s.nextEventId,
+		etagID:    s.nextEventId,
+		published: time.Now(),
+		layoutID:  kl.layoutID,
+		region:    region,
+	})
+	s.nextEventId++
+}
+
+// kioskLayoutResponse returns the layout of a kiosk and the signs in its
+// regions. It must be called with s.mux held.
+func (s *DisplayServer) kioskLayoutResponse(kioskID int32) *pb.KioskLayout {
+	response := &pb.KioskLayout{KioskId: kioskID}
+	if kl := s.layoutsForKioskIds[kioskID]; kl != nil {
+		response.LayoutId = kl.layoutID
+		response.SignIds = make(map[string]int32)
+		for region, signID := range kl.signIDs {
+			response.SignIds[region] = signID
+		}
+	}
+	return response
+}
+
+// CreateLayout creates a layout.
+func (s *DisplayServer) CreateLayout(c context.Context, r *pb.Layout) (*pb.Layout, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := checkLayout(r); err != nil {
+		return nil, err
+	}
+	layout := &pb.Layout{
+		Id:         s.nextLayoutId,
+		Name:       r.Name,
+		Regions:    r.Regions,
+		CreateTime: timestamppb.Now(),
+	}
+	s.nextLayoutId++
+	s.layouts[layout.Id] = layout
+	s.audit(c, "CreateLayout", layoutName(layout.Id), r, nil, layout)
+	return layout, nil
+}
+
+// ListLayouts returns all layouts.
+func (s *DisplayServer) ListLayouts(c context.Context, r *google_protobuf.Empty) (*pb.ListLayoutsResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	response := &pb.ListLayoutsResponse{}
+	var id int32
+	for id = 1; id < s.nextLayoutId; id++ {
+		if layout := s.layouts[id]; layout != nil {
+			response.Layouts = append(response.Layouts, layout)
+		}
+	}
+	return response, nil
+}
+
+// GetLayout returns the layout with ID r.Id.
+func (s *DisplayServer) GetLayout(c context.Context, r *pb.GetLayoutRequest) (*pb.Layout, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	layout := s.layouts[r.Id]
+	if layout == nil {
+		return nil, status.Errorf(codes.NotFound, "invalid layout id %d", r.Id)
+	}
+	return layout, nil
+}
+
+// DeleteLayout deletes the layout with ID r.Id. Layouts that kiosks use
+// can't be deleted, even if the kiosks are deleted, until the kiosks have
+// been purged.
+func (s *DisplayServer) DeleteLayout(c context.Context, r *pb.DeleteLayoutRequest) (*google_protobuf.Empty, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	layout := s.layouts[r.Id]
+	if layout == nil {
+		return nil, status.Errorf(codes.NotFound, "invalid layout id %d", r.Id)
+	}
+	for kioskID, kl := range s.layoutsForKioskIds {
+		if kl.layoutID == r.Id {
+			return nil, status.Errorf(codes.FailedPrecondition, "kiosk %d uses layout %d", kioskID, r.Id)
+		}
+	}
+	delete(s.layouts, r.Id)
+	s.audit(c, "DeleteLayout", layoutName(r.Id), r, layout, nil)
+	return &google_protobuf.Empty{}, nil
+}
+
+// SetKioskLayout sets the layout of the kiosk with ID r.KioskId and the
+// signs in its regions. A kiosk whose layout changes is sent its own
+// assignment, with the new layout, and then all of its regions; otherwise
+// only the regions whose signs change are sent.
+func (s *DisplayServer) SetKioskLayout(c context.Context, r *pb.KioskLayout) (*pb.KioskLayout, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	kioskID := r.KioskId
+	if s.activeKiosk(kioskID) == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	signIDs := make(map[string]int32)
+	if r.LayoutId == 0 {
+		if len(r.SignIds) > 0 {
+			return nil, status.Error(codes.InvalidArgument, "a kiosk without a layout has no regions")
+		}
+	} else {
+		layout := s.layouts[r.LayoutId]
+		if layout == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid layout id %d", r.LayoutId)
+		}
+		for region, signID := range r.SignIds {
+			if !hasRegion(layout, region) {
+				return nil, status.Errorf(codes.InvalidArgument, "layout %d has no region %q", r.LayoutId, region)
+			}
+			if signID == 0 {
+				continue
+			}
+			if s.activeSign(signID) == nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid sign id %d", signID)
+			}
+			signIDs[region] = signID
+		}
+	}
+	before := s.kioskLayoutResponse(kioskID)
+	if r.LayoutId != s.layoutId(kioskID) {
+		if r.LayoutId == 0 {
+			delete(s.layoutsForKioskIds, kioskID)
+		} else {
+			s.layoutsForKioskIds[kioskID] = &kioskLayout{
+				layoutID: r.LayoutId,
+				signIDs:  signIDs,
+				eventIDs: make(map[string]int64),
+			}
+		}
+		s.refreshKiosks([]int32{kioskID})
+	} else if kl := s.layoutsForKioskIds[kioskID]; kl != nil {
+		old := kl.signIDs
+		kl.signIDs = signIDs
+		for _, region := range s.layouts[kl.layoutID].Regions {
+			if old[region.Name] != signIDs[region.Name] && s.overridesForKioskIds[kioskID] == nil {
+				s.sendRegion(kioskID, region.Name)
+			}
+		}
+	}
+	after := s.kioskLayoutResponse(kioskID)
+	s.audit(c, "SetKioskLayout", kioskName(kioskID)+"/layout", r, before, after)
+	return after, nil
+}
+
+// GetKioskLayout returns the layout of the kiosk with ID r.KioskId and the
+// signs in its regions.
+func (s *DisplayServer) GetKioskLayout(c context.Context, r *pb.GetKioskLayoutRequest) (*pb.KioskLayout, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeKiosk(r.KioskId) == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	return s.kioskLayoutResponse(r.KioskId), nil
+}
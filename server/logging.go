@@ -0,0 +1,161 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDKey is the metadata key that carries request IDs. Clients may set
+// it to correlate their logs with the server's; otherwise the server assigns
+// one. Either way it is returned in the response headers.
+const requestIDKey = "x-request-id"
+
+type requestIDContextKey struct{}
+
+// RequestID returns the ID of the request being handled with ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// withRequestID returns a context that carries the request ID from the
+// incoming metadata, or a new one, and sends that ID back to the client.
+func withRequestID(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(requestIDKey); len(values) > 0 {
+			id = values[0]
+		}
+	}
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id))
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// NewLogger returns a logger that writes records at or above level ("debug",
+// "info", "warn" or "error") to w as "text" or "json". Records logged with a
+// context include its request and trace IDs.
+func NewLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: l}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// contextHandler adds request and trace IDs from the context to records.
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle implements slog.Handler.
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler.
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// LoggingUnaryInterceptor assigns each unary RPC a request ID and logs its
+// method, peer, status code and duration.
+func LoggingUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx = withRequestID(ctx)
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logRPC(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+// LoggingStreamInterceptor assigns each streaming RPC a request ID and logs
+// its method, peer, status code and duration.
+func LoggingStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := withRequestID(ss.Context())
+	start := time.Now()
+	err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	logRPC(ctx, info.FullMethod, start, err)
+	return err
+}
+
+func logRPC(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	if code != codes.OK {
+		level = slog.LevelWarn
+	}
+	attrs := []any{
+		"method", method,
+		"code", code.String(),
+		"duration", time.Since(start),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		attrs = append(attrs, "peer", p.Addr.String())
+	}
+	if err != nil {
+		attrs = append(attrs, "error", status.Convert(err).Message())
+	}
+	slog.Log(ctx, level, "rpc", attrs...)
+}
+
+// contextStream is a grpc.ServerStream with a replaced context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context implements grpc.ServerStream.
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+)
+
+// A manifest collects the distinct sign revisions that a kiosk needs.
+type manifest struct {
+	*pb.KioskManifest
+	added map[assignment]bool
+}
+
+// addToManifest adds a revision of a sign to a manifest, or the latest
+// revision if revisionID is 0, unless the sign has been deleted or the
+// revision is already in the manifest. Signs made from templates get the
+// template's content for the kiosk, and values from the data feed are
+// filled in. It must be called with s.mux held.
+func (s *DisplayServer) addToManifest(m *manifest, signID int32, revisionID int32, reason pb.ManifestEntry_Reason) {
+	sign := s.activeSign(signID)
+	if sign == nil {
+		return
+	}
+	if revisionID == 0 {
+		revisionID = sign.RevisionId
+	}
+	revision := s.revision(signID, revisionID)
+	key := assignment{signID: signID, revisionID: revisionID}
+	if revision == nil || m.added[key] {
+		return
+	}
+	m.added[key] = true
+	entry := &pb.ManifestEntry{
+		SignId:     signID,
+		RevisionId: revisionID,
+		Text:       revision.Text,
+		ImageHash:  revision.ImageHash,
+		Reason:     reason,
+	}
+	if template := s.templates[sign.TemplateId]; template != nil {
+		entry.Text = fillIn(template.Text, s.templateVariables(m.KioskId, signID)...)
+		entry.ImageHash = template.ImageHash
+	}
+	entry.Text = s.fillInData(entry.Text)
+	m.Entries = append(m.Entries, entry)
+}
+
+// GetKioskManifest returns the sign revisions that the kiosk with ID
+// r.KioskId needs: the ones it shows on the whole screen and in the regions
+// of its layout, those that clearing an emergency override would restore,
+// those that running rollouts will set on it, and those that aborting
+// rollouts would restore.
+func (s *DisplayServer) GetKioskManifest(c context.Context, r *pb.GetKioskManifestRequest) (*pb.KioskManifest, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeKiosk(r.KioskId) == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	m := &manifest{
+		KioskManifest: &pb.KioskManifest{KioskId: r.KioskId},
+		added:         make(map[assignment]bool),
+	}
+	current := s.assignment(r.KioskId)
+	s.addToManifest(m, s.signIdsForKioskIds[r.KioskId], s.revisionIdsForKioskIds[r.KioskId], pb.ManifestEntry_ASSIGNED)
+	if s.overridesForKioskIds[r.KioskId] != nil {
+		s.addToManifest(m, current.signID, current.revisionID, pb.ManifestEntry_ROLLBACK)
+	}
+	if kl := s.layoutsForKioskIds[r.KioskId]; kl != nil {
+		reason := pb.ManifestEntry_ASSIGNED
+		if s.overridesForKioskIds[r.KioskId] != nil {
+			reason = pb.ManifestEntry_ROLLBACK
+		}
+		for _, region := range s.layouts[kl.layoutID].Regions {
+			s.addToManifest(m, kl.signIDs[region.Name], 0, reason)
+		}
+	}
+	var id int32
+	for id = 1; id < s.nextRolloutId; id++ {
+		ro := s.rollouts[id]
+		if ro == nil || ro.State == pb.Rollout_ABORTED {
+			continue
+		}
+		if ro.State != pb.Rollout_SUCCEEDED {
+			for _, pending := range ro.KioskIds[ro.UpdatedKioskCount:] {
+				if pending == r.KioskId {
+					s.addToManifest(m, ro.SignId, ro.RevisionId, pb.ManifestEntry_ROLLOUT)
+				}
+			}
+		}
+		if previous, ok := ro.previous[r.KioskId]; ok && current.signID == ro.SignId && current.revisionID == ro.RevisionId {
+			s.addToManifest(m, previous.signID, previous.revisionID, pb.ManifestEntry_ROLLBACK)
+		}
+	}
+	return m.KioskManifest, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	rpcStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_started_total",
+		Help: "Number of RPCs started on the server.",
+	}, []string{"grpc_method"})
+	rpcHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "Number of RPCs completed on the server, by status code.",
+	}, []string{"grpc_method", "grpc_code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Help:    "Time taken by the server to complete RPCs.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"grpc_method"})
+	fanoutLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kiosk_sign_fanout_seconds",
+		Help:    "Time from a SetSignIdForKioskIds call until each subscribed kiosk has been sent the change.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	})
+)
+
+// RegisterMetrics registers the server's metrics with the default
+// Prometheus registry.
+func RegisterMetrics(s *DisplayServer) {
+	prometheus.MustRegister(rpcStarted, rpcHandled, rpcDuration, fanoutLatency)
+	prometheus.MustRegister(&displayCollector{s: s})
+}
+
+// MetricsUnaryInterceptor counts unary RPCs and measures their duration.
+func MetricsUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	rpcStarted.WithLabelValues(info.FullMethod).Inc()
+	resp, err := handler(ctx, req)
+	observeRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+// MetricsStreamInterceptor counts streaming RPCs and measures their duration.
+func MetricsStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	rpcStarted.WithLabelValues(info.FullMethod).Inc()
+	err := handler(srv, ss)
+	observeRPC(info.FullMethod, start, err)
+	return err
+}
+
+func observeRPC(method string, start time.Time, err error) {
+	rpcHandled.WithLabelValues(method, status.Code(err).String()).Inc()
+	rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// observeFanout records how long a sign change took to reach a subscriber.
+func observeFanout(update signUpdate) {
+	fanoutLatency.Observe(time.Since(update.published).Seconds())
+}
+
+// displayCollector reports gauges computed from the server's state when
+// metrics are scraped.
+type displayCollector struct {
+	s *DisplayServer
+}
+
+var (
+	kiosksDesc = prometheus.NewDesc("kiosk_kiosks",
+		"Number of enrolled kiosks, not counting deleted ones.", nil, nil)
+	signsDesc = prometheus.NewDesc("kiosk_signs",
+		"Number of signs, not counting deleted ones.", nil, nil)
+	subscribersDesc = prometheus.NewDesc("kiosk_subscribers",
+		"Number of active subscribers to sign changes.", nil, nil)
+	imageBytesDesc = prometheus.NewDesc("kiosk_image_bytes",
+		"Total size of the distinct images stored for signs, their revisions and screenshots.", nil, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (c *displayCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- kiosksDesc
+	ch <- signsDesc
+	ch <- subscribersDesc
+	ch <- imageBytesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *displayCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.s
+	s.mux.Lock()
+	kiosks, signs := 0, 0
+	for id := range s.kiosks {
+		if s.activeKiosk(id) != nil {
+			kiosks++
+		}
+	}
+	for id := range s.signs {
+		if s.activeSign(id) != nil {
+			signs++
+		}
+	}
+	subscribers := 0
+	for _, subscribersForKiosk := range s.subscribers {
+		subscribers += len(subscribersForKiosk)
+	}
+	imageBytes := s.imageBytes
+	s.mux.Unlock()
+	ch <- prometheus.MustNewConstMetric(kiosksDesc, prometheus.GaugeValue, float64(kiosks))
+	ch <- prometheus.MustNewConstMetric(signsDesc, prometheus.GaugeValue, float64(signs))
+	ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(subscribers))
+	ch <- prometheus.MustNewConstMetric(imageBytesDesc, prometheus.GaugeValue, float64(imageBytes))
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// earthRadiusMeters is the mean radius of the Earth.
+const earthRadiusMeters = 6371008.8
+
+// An override is an Override with the assignments of its kiosks, which are
+// restored when it is cleared.
+type override struct {
+	*pb.Override
+	previous map[int32]assignment // by kiosk id
+}
+
+// overrideName returns the audit resource name of an emergency override.
+func overrideName(id int32) string {
+	return fmt.Sprintf("emergencyOverrides/%d", id)
+}
+
+// assignment returns the sign that a kiosk shows or, if it is under an
+// emergency override, the sign that it will show when the override is
+// cleared. It must be called with s.mux held.
+func (s *DisplayServer) assignment(kioskID int32) assignment {
+	if o := s.overridesForKioskIds[kioskID]; o != nil {
+		return o.previous[kioskID]
+	}
+	return assignment{
+		signID:     s.signIdsForKioskIds[kioskID],
+		revisionID: s.revisionIdsForKioskIds[kioskID],
+	}
+}
+
+// distance returns the great-circle distance in meters between two points.
+func distance(a, b *latlng.LatLng) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLng/2), 2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// checkRegion returns an error if a region isn't a valid circle.
+func checkRegion(region *pb.Override_Region) error {
+	center := region.Center
+	if center == nil || center.Latitude < -90 || center.Latitude > 90 || center.Longitude < -180 || center.Longitude > 180 {
+		return status.Error(codes.InvalidArgument, "region: a valid center is required")
+	}
+	if !(region.RadiusMeters > 0) {
+		return status.Error(codes.InvalidArgument, "region: radius_meters must be positive")
+	}
+	return nil
+}
+
+// inRegion returns true if a kiosk is located in a region or the region is
+// nil. Kiosks without a location are in no region.
+func inRegion(k *pb.Kiosk, region *pb.Override_Region) bool {
+	if region == nil {
+		return true
+	}
+	return k.Location != nil && distance(k.Location, region.Center) <= region.RadiusMeters
+}
+
+// applyOverrides puts a kiosk that was just created or undeleted under the
+// latest active emergency override that covers it, as if it had been
+// there when the override started. Changes are audited as made by request
+// r to method. It must be called with s.mux held.
+func (s *DisplayServer) applyOverrides(c context.Context, method string, r proto.Message, kioskID int32) {
+	k := s.activeKiosk(kioskID)
+	for id := s.nextOverrideId - 1; id > 0; id-- {
+		o := s.overrides[id]
+		if o == nil || o.State != pb.Override_ACTIVE || !inRegion(k, o.Region) {
+			continue
+		}
+		if _, ok := o.previous[kioskID]; !ok {
+			o.previous[kioskID] = s.assignment(kioskID)
+			o.KioskIds = append(o.KioskIds, kioskID)
+		}
+		delete(s.overridesForKioskIds, kioskID)
+		s.assignSign(c, method, r, []int32{kioskID}, o.SignId, o.RevisionId)
+		s.overridesForKioskIds[kioskID] = o
+		s.sendRegions(kioskID)
+		return
+	}
+}
+
+// EmergencyOverride sets a sign on all active kiosks, or those in
+// r.Region, and keeps it there until the override is cleared. The regions
+// of their layouts show the sign too. Kiosks that are already under
+// another override are taken over by this one, and kiosks that are
+// created or undeleted in r.Region while it is active join it.
+func (s *DisplayServer) EmergencyOverride(c context.Context, r *pb.EmergencyOverrideRequest) (*pb.Override, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeSign(r.SignId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sign id %d", r.SignId)
+	}
+	if r.RevisionId != 0 && s.revision(r.SignId, r.RevisionId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "sign %d has no revision %d", r.SignId, r.RevisionId)
+	}
+	if r.Region != nil {
+		if err := checkRegion(r.Region); err != nil {
+			return nil, err
+		}
+	}
+	o := &override{
+		Override: &pb.Override{
+			Id:         s.nextOverrideId,
+			SignId:     r.SignId,
+			RevisionId: r.RevisionId,
+			Region:     r.Region,
+			Reason:     r.Reason,
+			State:      pb.Override_ACTIVE,
+			Creator:    Principal(c),
+			CreateTime: timestamppb.Now(),
+		},
+		previous: make(map[int32]assignment),
+	}
+	var kioskID int32
+	for kioskID = 1; kioskID < s.nextKioskId; kioskID++ {
+		if k := s.activeKiosk(kioskID); k == nil || !inRegion(k, r.Region) {
+			continue
+		}
+		o.previous[kioskID] = s.assignment(kioskID)
+		delete(s.overridesForKioskIds, kioskID)
+		o.KioskIds = append(o.KioskIds, kioskID)
+	}
+	if len(o.KioskIds) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "there are no kiosks to override")
+	}
+	s.nextOverrideId++
+	s.overrides[o.Id] = o
+	s.assignSign(c, "EmergencyOverride", r, o.KioskIds, o.SignId, o.RevisionId)
+	for _, kioskID := range o.KioskIds {
+		s.overridesForKioskIds[kioskID] = o
+		s.sendRegions(kioskID)
+	}
+	s.audit(c, "EmergencyOverride", overrideName(o.Id), r, nil, o.Override)
+	return proto.Clone(o.Override).(*pb.Override), nil
+}
+
+// ListEmergencyOverrides returns all emergency overrides.
+func (s *DisplayServer) ListEmergencyOverrides(c context.Context, r *google_protobuf.Empty) (*pb.ListEmergencyOverridesResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	response := &pb.ListEmergencyOverridesResponse{}
+	var id int32
+	for id = 1; id < s.nextOverrideId; id++ {
+		if o := s.overrides[id]; o != nil {
+			response.Overrides = append(response.Overrides, proto.Clone(o.Override).(*pb.Override))
+		}
+	}
+	return response, nil
+}
+
+// latestOverride returns the most recent active emergency override that
+// covers a kiosk, or nil if there is none. It must be called with s.mux
+// held.
+func (s *DisplayServer) latestOverride(kioskID int32) *override {
+	for id := s.nextOverrideId - 1; id > 0; id-- {
+		if o := s.overrides[id]; o != nil && o.State == pb.Override_ACTIVE {
+			if _, ok := o.previous[kioskID]; ok {
+				return o
+			}
+		}
+	}
+	return nil
+}
+
+// ClearEmergencyOverride ends the emergency override with ID r.Id. Its
+// kiosks return to the most recent override that still covers them or,
+// if there is none, to their own signs, including any that were set on
+// them while it was active. Kiosks taken over by a later override are left
+// to that override.
+func (s *DisplayServer) ClearEmergencyOverride(c context.Context, r *pb.ClearEmergencyOverrideRequest) (*pb.Override, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	o := s.overrides[r.Id]
+	if o == nil {
+		return nil, status.Errorf(codes.NotFound, "invalid emergency override id %d", r.Id)
+	}
+	if o.State != pb.Override_ACTIVE {
+		return nil, status.Errorf(codes.FailedPrecondition, "emergency override %d is %s", r.Id, o.State)
+	}
+	before := proto.Clone(o.Override)
+	o.State = pb.Override_CLEARED
+	o.Clearer = Principal(c)
+	o.ClearTime = timestamppb.Now()
+	kioskIDs := make(map[assignment][]int32)
+	order := []assignment{}
+	returning := make(map[int32]*override)
+	for _, kioskID := range o.KioskIds {
+		if s.overridesForKioskIds[kioskID] != o {
+			continue
+		}
+		delete(s.overridesForKioskIds, kioskID)
+		next := o.previous[kioskID]
+		if older := s.latestOverride(kioskID); older != nil {
+			older.previous[kioskID] = next
+			returning[kioskID] = older
+			next = assignment{signID: older.SignId, revisionID: older.RevisionId}
+		}
+		if kioskIDs[next] == nil {
+			order = append(order, next)
+		}
+		kioskIDs[next] = append(kioskIDs[next], kioskID)
+	}
+	for _, next := range order {
+		s.assignSign(c, "ClearEmergencyOverride", r, kioskIDs[next], next.signID, next.revisionID)
+		for _, kioskID := range kioskIDs[next] {
+			if older := returning[kioskID]; older != nil {
+				s.overridesForKioskIds[kioskID] = older
+			}
+			s.sendRegions(kioskID)
+		}
+	}
+	s.audit(c, "ClearEmergencyOverride", overrideName(o.Id), r, before, o.Override)
+	return proto.Clone(o.Override).(*pb.Override), nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/type/date"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// maxClockSkew is how far in the future a play may start, to allow for
+// kiosk clocks that are ahead of the server's.
+const maxClockSkew = time.Minute
+
+// A playKey identifies the plays of a sign on a kiosk on a day, which is
+// formatted as YYYY-MM-DD so that keys sort by date.
+type playKey struct {
+	signID  int32
+	kioskID int32
+	day     string
+}
+
+// playTotals sums the plays with a playKey.
+type playTotals struct {
+	impressions int64
+	onScreen    time.Duration
+}
+
+// dayOf returns the UTC day of a time, formatted for a playKey.
+func dayOf(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// dayOfDate returns the day of a date, formatted for a playKey.
+func dayOfDate(d *date.Date) (string, error) {
+	t := time.Date(int(d.Year), time.Month(d.Month), int(d.Day), 0, 0, 0, 0, time.UTC)
+	if d.Year < 1 || d.Month < 1 || d.Month > 12 || d.Day < 1 || t.Day() != int(d.Day) {
+		return "", fmt.Errorf("invalid date %d-%d-%d", d.Year, d.Month, d.Day)
+	}
+	return dayOf(t), nil
+}
+
+// dateOfDay returns the date of a day formatted for a playKey.
+func dateOfDay(day string) *date.Date {
+	t, _ := time.Parse("2006-01-02", day)
+	return &date.Date{Year: int32(t.Year()), Month: int32(t.Month()), Day: int32(t.Day())}
+}
+
+// checkPlay returns an error if a play event is invalid. It must be called
+// with s.mux held.
+func (s *DisplayServer) checkPlay(event *pb.PlayEvent, now time.Time) error {
+	if s.signs[event.SignId] == nil {
+		return status.Errorf(codes.InvalidArgument, "invalid sign id %d", event.SignId)
+	}
+	if event.RevisionId != 0 && s.revision(event.SignId, event.RevisionId) == nil {
+		return status.Errorf(codes.InvalidArgument, "sign %d has no revision %d", event.SignId, event.RevisionId)
+	}
+	if event.StartTime == nil || event.StartTime.CheckValid() != nil {
+		return status.Error(codes.InvalidArgument, "a valid start_time is required")
+	}
+	if event.StartTime.AsTime().After(now.Add(maxClockSkew)) {
+		return status.Error(codes.InvalidArgument, "start_time is in the future")
+	}
+	if event.Duration != nil {
+		if err := event.Duration.CheckValid(); err != nil || event.Duration.AsDuration() < 0 {
+			return status.Error(codes.InvalidArgument, "invalid duration")
+		}
+	}
+	return nil
+}
+
+// ReportPlays records that a kiosk displayed signs. The kiosk is seen and
+// its displayed sign becomes the one that started last. Either every event
+// is recorded or, if any is invalid, none is.
+func (s *DisplayServer) ReportPlays(c context.Context, r *pb.ReportPlaysRequest) (*google_protobuf.Empty, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeKiosk(r.KioskId) == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	if err := s.reportPlays(r.KioskId, r.Events); err != nil {
+		return nil, err
+	}
+	return &google_protobuf.Empty{}, nil
+}
+
+// recentPlayEventIds returns the ids of the plays recently reported by a kiosk,
+// forgetting those that have expired. It must be called with s.mux held.
+func (s *DisplayServer) recentPlayEventIds(kioskID int32, now time.Time) map[string]time.Time {
+	ids := s.playEventIds[kioskID]
+	if ids == nil {
+		ids = make(map[string]time.Time)
+		s.playEventIds[kioskID] = ids
+	}
+	for id, expires := range ids {
+		if now.After(expires) {
+			delete(ids, id)
+		}
+	}
+	return ids
+}
+
+// reportPlays records plays on a kiosk as described by ReportPlays, except
+// those with the event id of a play that was already recorded. It must be
+// called with s.mux held.
+func (s *DisplayServer) reportPlays(kioskID int32, events []*pb.PlayEvent) error {
+	now := time.Now()
+	for i, event := range events {
+		if err := s.checkPlay(event, now); err != nil {
+			return itemError("events", i, err)
+		}
+	}
+	st := s.seen(kioskID, now)
+	eventIDs := s.recentPlayEventIds(kioskID, now)
+	var last time.Time
+	for _, event := range events {
+		if event.EventId != "" {
+			if _, ok := eventIDs[event.EventId]; ok {
+				continue
+			}
+			if s.RequestRetention > 0 {
+				eventIDs[event.EventId] = now.Add(s.RequestRetention)
+			}
+		}
+		start := event.StartTime.AsTime()
+		key := playKey{signID: event.SignId, kioskID: kioskID, day: dayOf(start)}
+		totals := s.plays[key]
+		if totals == nil {
+			totals = &playTotals{}
+			s.plays[key] = totals
+		}
+		totals.impressions++
+		totals.onScreen += event.Duration.AsDuration()
+		if !start.Before(last) {
+			last = start
+			st.displayedSignID = event.SignId
+			st.displayedRevisionID = event.RevisionId
+		}
+	}
+	return nil
+}
+
+// QueryPlayReports returns the plays of each sign on each kiosk on each day
+// that match r.
+func (s *DisplayServer) QueryPlayReports(c context.Context, r *pb.QueryPlayReportsRequest) (*pb.QueryPlayReportsResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var start, end string
+	var err error
+	if r.StartDate != nil {
+		if start, err = dayOfDate(r.StartDate); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "start_date: %v", err)
+		}
+	}
+	if r.EndDate != nil {
+		if end, err = dayOfDate(r.EndDate); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "end_date: %v", err)
+		}
+	}
+	keys := []playKey{}
+	for key := range s.plays {
+		if (r.SignId == 0 || key.signID == r.SignId) &&
+			(r.KioskId == 0 || key.kioskID == r.KioskId) &&
+			(start == "" || key.day >= start) &&
+			(end == "" || key.day <= end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].day != keys[j].day {
+			return keys[i].day < keys[j].day
+		}
+		if keys[i].signID != keys[j].signID {
+			return keys[i].signID < keys[j].signID
+		}
+		return keys[i].kioskID < keys[j].kioskID
+	})
+	response := &pb.QueryPlayReportsResponse{}
+	for _, key := range keys {
+		totals := s.plays[key]
+		response.Reports = append(response.Reports, &pb.PlayReport{
+			SignId:       key.signID,
+			KioskId:      key.kioskID,
+			Date:         dateOfDay(key.day),
+			Impressions:  totals.impressions,
+			OnScreenTime: durationpb.New(totals.onScreen),
+		})
+	}
+	return response, nil
+}
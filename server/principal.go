@@ -0,0 +1,186 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// gatewayTokenKey is the metadata key with which the REST gateway proves
+// that a request came through it.
+const gatewayTokenKey = "x-kiosk-gateway-token"
+
+var (
+	// gatewayToken is a secret that the REST gateway sends with every
+	// request. It is created when the server starts.
+	gatewayToken = newGatewayToken()
+	// trustedProxies are the networks of proxies, such as the Cloud
+	// Endpoints proxy, whose identity headers are trusted.
+	trustedProxies []*net.IPNet
+)
+
+// newGatewayToken returns a random token for the REST gateway.
+func newGatewayToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SetTrustedProxies sets the proxies whose identity headers are trusted
+// from a comma-separated list of addresses and CIDR ranges.
+func SetTrustedProxies(proxies string) error {
+	trustedProxies = nil
+	for _, proxy := range strings.Split(proxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+// trustedProxy reports whether a request came from a trusted proxy.
+func trustedProxy(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	for _, network := range trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromGateway reports whether a request came through the REST gateway.
+func fromGateway(tokens []string) bool {
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(gatewayToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal describes the caller that made a request. In order of
+// preference, it is the user identified by a Cloud Endpoints proxy, the
+// subject of a TLS client certificate, the prefix of an API key, or the
+// address that the request came from. Users, API keys and forwarded
+// addresses are only believed from trusted proxies, and forwarded addresses
+// from the REST gateway, so that callers can't pose as someone else.
+func Principal(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var address, subject string
+	if p, _ := peer.FromContext(ctx); p != nil {
+		address = p.Addr.String()
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if certs := tlsInfo.State.PeerCertificates; len(certs) > 0 {
+				subject = certs[0].Subject.CommonName
+			}
+		}
+	}
+	return principal(func(key string) string { return first(md, key) }, md.Get(gatewayTokenKey), address, subject)
+}
+
+// HTTPPrincipal describes the caller that made an HTTP request that isn't
+// passed to the gRPC server, like Principal does for gRPC requests.
+func HTTPPrincipal(r *http.Request) string {
+	var subject string
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		subject = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return principal(r.Header.Get, nil, r.RemoteAddr, subject)
+}
+
+// principal returns the principal of a request with headers from get, the
+// gateway tokens it carries, the address that it came from and the subject
+// of its client certificate, if any.
+func principal(get func(key string) string, tokens []string, address string, subject string) string {
+	proxied := trustedProxy(address)
+	if info := get("x-endpoint-api-userinfo"); proxied && info != "" {
+		if b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(info, "=")); err == nil {
+			var user struct {
+				Email string `json:"email"`
+				ID    string `json:"id"`
+			}
+			if json.Unmarshal(b, &user) == nil {
+				if user.Email != "" {
+					return user.Email
+				}
+				if user.ID != "" {
+					return user.ID
+				}
+			}
+		}
+	}
+	if subject != "" {
+		return "cert:" + subject
+	}
+	for _, key := range []string{"x-goog-api-key", "x-api-key"} {
+		if apiKey := get(key); proxied && apiKey != "" {
+			if len(apiKey) > 8 {
+				apiKey = apiKey[:8]
+			}
+			return "apikey:" + apiKey
+		}
+	}
+	// Proxies append the address that they were called from, so the last
+	// forwarded address is the only one that a caller can't choose.
+	if forwarded := get("x-forwarded-for"); forwarded != "" && (proxied || fromGateway(tokens)) {
+		addresses := strings.Split(forwarded, ",")
+		return "ip:" + strings.TrimSpace(addresses[len(addresses)-1])
+	}
+	if address == "" {
+		return "unknown"
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + address
+}
+
+// first returns the first value of a metadata key, or "".
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
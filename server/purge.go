@@ -0,0 +1,90 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// deleteTimes returns the delete and expire times of a resource that is
+// deleted now.
+func (s *DisplayServer) deleteTimes() (*timestamppb.Timestamp, *timestamppb.Timestamp) {
+	now := time.Now()
+	return timestamppb.New(now), timestamppb.New(now.Add(s.DeleteRetention))
+}
+
+// Purge permanently removes deleted kiosks and signs that expired before
+// now. It returns the number of kiosks and signs removed.
+func (s *DisplayServer) Purge(now time.Time) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	purged := 0
+	for id, k := range s.kiosks {
+		if k.ExpireTime != nil && k.ExpireTime.AsTime().Before(now) {
+			delete(s.kiosks, id)
+			delete(s.signIdsForKioskIds, id)
+			delete(s.revisionIdsForKioskIds, id)
+			delete(s.eventIdsForKioskIds, id)
+			delete(s.etagIdsForKioskIds, id)
+			delete(s.statuses, id)
+			delete(s.playEventIds, id)
+			delete(s.commands, id)
+			s.removeScreenshots(id)
+			delete(s.overridesForKioskIds, id)
+			delete(s.variablesForKioskIds, id)
+			delete(s.layoutsForKioskIds, id)
+			slog.Info("purged kiosk", "kiosk_id", id)
+			purged++
+		}
+	}
+	for id, sign := range s.signs {
+		if sign.ExpireTime != nil && sign.ExpireTime.AsTime().Before(now) {
+			s.removeRevisions(id)
+			for _, variables := range s.variablesForKioskIds {
+				delete(variables, id)
+			}
+			for _, kl := range s.layoutsForKioskIds {
+				for region, signID := range kl.signIDs {
+					if signID == id {
+						delete(kl.signIDs, region)
+					}
+				}
+			}
+			delete(s.signs, id)
+			slog.Info("purged sign", "sign_id", id)
+			purged++
+		}
+	}
+	return purged
+}
+
+// RunPurger purges expired kiosks and signs every interval until ctx is
+// done.
+func (s *DisplayServer) RunPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Purge(now)
+		}
+	}
+}
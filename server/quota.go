@@ -0,0 +1,156 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Quotas limit the resources that a DisplayServer will hold. Zero values
+// are unlimited.
+type Quotas struct {
+	MaxKiosks          int   // number of kiosks
+	MaxSigns           int   // number of signs
+	MaxImageBytes      int64 // total size of sign and template images
+	MaxScreenshotBytes int64 // total size of screenshots
+	MaxStreamsPerKiosk int   // concurrent streams watching one kiosk
+}
+
+// quotaRetryDelay is how long clients are asked to wait before retrying a
+// request that exceeded a quota. Quotas are only freed by other requests,
+// so this is a guess.
+const quotaRetryDelay = 30 * time.Second
+
+// resourceExhausted returns a ResourceExhausted error that asks the client to
+// retry after delay.
+func resourceExhausted(delay time.Duration, format string, a ...interface{}) error {
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf(format, a...))
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(delay),
+	}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// checkStreamQuota returns an error if another stream can't watch a kiosk.
+// It must be called with s.mux held.
+func (s *DisplayServer) checkStreamQuota(kioskID int32) error {
+	if max := s.Quotas.MaxStreamsPerKiosk; max > 0 && len(s.subscribers[kioskID]) >= max {
+		return resourceExhausted(quotaRetryDelay, "kiosk %d already has %d streams", kioskID, max)
+	}
+	return nil
+}
+
+// A RateLimiter limits the rate of requests from each principal with a
+// token bucket that holds up to Burst tokens and refills at Rate tokens per
+// second.
+type RateLimiter struct {
+	Rate      rate.Limit
+	Burst     int
+	limiters  map[string]*principalLimiter
+	lastPrune time.Time
+	mux       sync.Mutex
+}
+
+type principalLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limiterIdleTime is how long a principal's bucket is kept after its last
+// request. Buckets that are idle this long are full anyway.
+const limiterIdleTime = 10 * time.Minute
+
+// NewRateLimiter creates a limiter that allows each principal r requests
+// per second with bursts of up to burst requests.
+func NewRateLimiter(r float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Rate:      rate.Limit(r),
+		Burst:     burst,
+		limiters:  make(map[string]*principalLimiter),
+		lastPrune: time.Now(),
+	}
+}
+
+// Allow takes a token from a principal's bucket. If the bucket is empty, it
+// returns an error that says when to retry.
+func (l *RateLimiter) Allow(principal string) error {
+	l.mux.Lock()
+	now := time.Now()
+	if now.Sub(l.lastPrune) > time.Minute {
+		for p, pl := range l.limiters {
+			if now.Sub(pl.lastSeen) > limiterIdleTime {
+				delete(l.limiters, p)
+			}
+		}
+		l.lastPrune = now
+	}
+	pl := l.limiters[principal]
+	if pl == nil {
+		pl = &principalLimiter{limiter: rate.NewLimiter(l.Rate, l.Burst)}
+		l.limiters[principal] = pl
+	}
+	pl.lastSeen = now
+	l.mux.Unlock()
+	reservation := pl.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return resourceExhausted(delay, "rate limit exceeded for %s", principal)
+	}
+	return nil
+}
+
+// exempt reports whether a method is not rate limited. Health checks are
+// exempt so that probes from busy hosts don't fail.
+func exempt(method string) bool {
+	return strings.HasPrefix(method, "/grpc.health.v1.Health/")
+}
+
+// UnaryInterceptor rejects unary requests from principals that exceed the
+// rate limit.
+func (l *RateLimiter) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !exempt(info.FullMethod) {
+		if err := l.Allow(Principal(ctx)); err != nil {
+			return nil, err
+		}
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor rejects streams from principals that exceed the rate
+// limit.
+func (l *RateLimiter) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !exempt(info.FullMethod) {
+		if err := l.Allow(Principal(ss.Context())); err != nil {
+			return err
+		}
+	}
+	return handler(srv, ss)
+}
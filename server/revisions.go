@@ -0,0 +1,227 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// A storedImage is an image that is used by one or more sign revisions or
+// screenshots. Images are stored once no matter how many use them.
+type storedImage struct {
+	data []byte
+	refs int
+}
+
+// imageHash returns the key of an image in the image store, or "" if there
+// is no image.
+func imageHash(image []byte) string {
+	if len(image) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(image)
+	return hex.EncodeToString(sum[:])
+}
+
+// uncountedImages returns the images that only deleted signs and screenshots
+// refer to, which don't count against the image quota. It must be called
+// with s.mux held.
+func (s *DisplayServer) uncountedImages() map[string]bool {
+	uncountedRefs := make(map[string]int)
+	for id, sign := range s.signs {
+		if sign.DeleteTime != nil {
+			for _, revision := range s.revisions[id] {
+				uncountedRefs[revision.ImageHash]++
+			}
+		}
+	}
+	for _, screenshots := range s.screenshots {
+		for _, screenshot := range screenshots {
+			uncountedRefs[screenshot.ImageHash]++
+		}
+	}
+	uncounted := make(map[string]bool)
+	for hash, refs := range uncountedRefs {
+		if stored := s.images[hash]; stored != nil && stored.refs == refs {
+			uncounted[hash] = true
+		}
+	}
+	return uncounted
+}
+
+// countedImageBytes returns the total size of the images that count against
+// the image quota. It must be called with s.mux held.
+func (s *DisplayServer) countedImageBytes(uncounted map[string]bool) int64 {
+	total := s.imageBytes
+	for hash := range uncounted {
+		total -= int64(len(s.images[hash].data))
+	}
+	return total
+}
+
+// checkImageQuota returns an error if storing an image would exceed the
+// image quota. It must be called with s.mux held.
+func (s *DisplayServer) checkImageQuota(image []byte) error {
+	max := s.Quotas.MaxImageBytes
+	hash := imageHash(image)
+	if max <= 0 || hash == "" {
+		return nil
+	}
+	uncounted := s.uncountedImages()
+	if s.images[hash] != nil && !uncounted[hash] {
+		return nil
+	}
+	if s.countedImageBytes(uncounted)+int64(len(image)) > max {
+		return resourceExhausted(quotaRetryDelay, "images would exceed %d bytes", max)
+	}
+	return nil
+}
+
+// retainImage adds a reference to an image, storing it if it is new, and
+// returns its hash. It must be called with s.mux held.
+func (s *DisplayServer) retainImage(image []byte) string {
+	hash := imageHash(image)
+	if hash == "" {
+		return ""
+	}
+	if stored := s.images[hash]; stored != nil {
+		stored.refs++
+	} else {
+		s.images[hash] = &storedImage{data: image, refs: 1}
+		s.imageBytes += int64(len(image))
+	}
+	return hash
+}
+
+// releaseImage removes a reference to an image and removes the image when
+// nothing refers to it. It must be called with s.mux held.
+func (s *DisplayServer) releaseImage(hash string) {
+	stored := s.images[hash]
+	if stored == nil {
+		return
+	}
+	stored.refs--
+	if stored.refs == 0 {
+		delete(s.images, hash)
+		s.imageBytes -= int64(len(stored.data))
+	}
+}
+
+// addRevision records the content of a sign as its next revision. It must be
+// called with s.mux held.
+func (s *DisplayServer) addRevision(c context.Context, sign *pb.Sign) {
+	revisions := s.revisions[sign.Id]
+	revision := &pb.SignRevision{
+		SignId:     sign.Id,
+		RevisionId: int32(len(revisions) + 1),
+		Text:       sign.Text,
+		ImageHash:  s.retainImage(sign.Image),
+		Author:     Principal(c),
+		CreateTime: timestamppb.Now(),
+	}
+	s.revisions[sign.Id] = append(revisions, revision)
+	sign.RevisionId = revision.RevisionId
+	sign.ImageHash = revision.ImageHash
+}
+
+// removeRevisions removes the revisions of a sign that is being purged. It
+// must be called with s.mux held.
+func (s *DisplayServer) removeRevisions(signID int32) {
+	for _, revision := range s.revisions[signID] {
+		s.releaseImage(revision.ImageHash)
+	}
+	delete(s.revisions, signID)
+}
+
+// revision returns a revision of a sign, or nil if there is no such
+// revision. It must be called with s.mux held.
+func (s *DisplayServer) revision(signID int32, revisionID int32) *pb.SignRevision {
+	revisions := s.revisions[signID]
+	if revisionID < 1 || int(revisionID) > len(revisions) {
+		return nil
+	}
+	return revisions[revisionID-1]
+}
+
+// ListSignRevisions returns the revisions of the sign with ID r.SignId.
+func (s *DisplayServer) ListSignRevisions(c context.Context, r *pb.ListSignRevisionsRequest) (*pb.ListSignRevisionsResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.signs[r.SignId] == nil {
+		return nil, errors.New("invalid sign id")
+	}
+	return &pb.ListSignRevisionsResponse{Revisions: s.revisions[r.SignId]}, nil
+}
+
+// GetSignRevision returns a revision of a sign with its image.
+func (s *DisplayServer) GetSignRevision(c context.Context, r *pb.GetSignRevisionRequest) (*pb.SignRevision, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.signs[r.SignId] == nil {
+		return nil, errors.New("invalid sign id")
+	}
+	revision := s.revision(r.SignId, r.RevisionId)
+	if revision == nil {
+		return nil, status.Errorf(codes.NotFound, "sign %d has no revision %d", r.SignId, r.RevisionId)
+	}
+	revision = proto.Clone(revision).(*pb.SignRevision)
+	if stored := s.images[revision.ImageHash]; stored != nil {
+		revision.Image = stored.data
+	}
+	return revision, nil
+}
+
+// RollbackSign restores the text and image of an earlier revision of a sign.
+// A sign made from a template can't be rolled back to a revision with text
+// or an image, since it has none of its own.
+func (s *DisplayServer) RollbackSign(c context.Context, r *pb.RollbackSignRequest) (*pb.Sign, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	old := s.activeSign(r.SignId)
+	if old == nil {
+		return nil, errors.New("invalid sign id")
+	}
+	if err := checkEtag(signName(r.SignId), r.Etag, old.Etag); err != nil {
+		return nil, err
+	}
+	revision := s.revision(r.SignId, r.RevisionId)
+	if revision == nil {
+		return nil, status.Errorf(codes.NotFound, "sign %d has no revision %d", r.SignId, r.RevisionId)
+	}
+	updated := proto.Clone(old).(*pb.Sign)
+	updated.Text = revision.Text
+	updated.Image = nil
+	if stored := s.images[revision.ImageHash]; stored != nil {
+		updated.Image = stored.data
+	}
+	if err := s.checkSignTemplate(updated); err != nil {
+		return nil, err
+	}
+	updated.Etag = s.newEtag()
+	s.addRevision(c, updated)
+	s.signs[r.SignId] = updated
+	s.audit(c, "RollbackSign", signName(r.SignId), r, old, updated)
+	s.signChanged(updated)
+	return updated, nil
+}
@@ -0,0 +1,304 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// A rollout is a Rollout with the assignments that it replaced, which are
+// restored if it is aborted.
+type rollout struct {
+	*pb.Rollout
+	previous map[int32]assignment // by kiosk id
+}
+
+// An assignment is the sign shown by a kiosk.
+type assignment struct {
+	signID     int32
+	revisionID int32
+}
+
+// rolloutName returns the audit resource name of a rollout.
+func rolloutName(id int32) string {
+	return fmt.Sprintf("rollouts/%d", id)
+}
+
+// checkStages returns an error if the stages of a rollout aren't increasing
+// percentages that end at 100.
+func checkStages(stages []*pb.Rollout_Stage) error {
+	if len(stages) == 0 {
+		return status.Error(codes.InvalidArgument, "a rollout needs at least one stage")
+	}
+	percent := int32(0)
+	for i, stage := range stages {
+		if stage.Percent <= percent || stage.Percent > 100 {
+			return status.Errorf(codes.InvalidArgument, "stages[%d]: percent must be more than the previous stage's and at most 100", i)
+		}
+		percent = stage.Percent
+		if stage.Wait != nil {
+			if err := stage.Wait.CheckValid(); err != nil || stage.Wait.AsDuration() < 0 {
+				return status.Errorf(codes.InvalidArgument, "stages[%d]: invalid wait", i)
+			}
+		}
+	}
+	if percent != 100 {
+		return status.Error(codes.InvalidArgument, "the last stage must be at 100 percent")
+	}
+	return nil
+}
+
+// startStage sets the sign on the kiosks of a stage and waits for the next
+// stage. Changes are audited as made by request r to method. It must be
+// called with s.mux held.
+func (s *DisplayServer) startStage(c context.Context, method string, r proto.Message, ro *rollout, stage int) {
+	target := len(ro.KioskIds)
+	count := (int(ro.Stages[stage].Percent)*target + 99) / 100
+	kioskIDs := []int32{}
+	for _, kioskID := range ro.KioskIds[ro.UpdatedKioskCount:count] {
+		if s.activeKiosk(kioskID) == nil {
+			continue // deleted since the rollout started
+		}
+		ro.previous[kioskID] = s.assignment(kioskID)
+		kioskIDs = append(kioskIDs, kioskID)
+	}
+	s.assignSign(c, method, r, kioskIDs, ro.SignId, ro.RevisionId)
+	ro.CurrentStage = int32(stage)
+	ro.UpdatedKioskCount = int32(count)
+	if stage == len(ro.Stages)-1 {
+		ro.State = pb.Rollout_SUCCEEDED
+		ro.NextStageTime = nil
+	} else {
+		s.waitForNextStage(ro)
+	}
+}
+
+// waitForNextStage starts waiting for the next stage of a rollout, either
+// for the current stage's wait or for approval.
+func (s *DisplayServer) waitForNextStage(ro *rollout) {
+	if wait := ro.Stages[ro.CurrentStage].Wait; wait != nil {
+		ro.State = pb.Rollout_RUNNING
+		ro.NextStageTime = timestamppb.New(time.Now().Add(wait.AsDuration()))
+	} else {
+		ro.State = pb.Rollout_AWAITING_APPROVAL
+		ro.NextStageTime = nil
+	}
+}
+
+// CreateRollout starts rolling out a sign and runs its first stage.
+func (s *DisplayServer) CreateRollout(c context.Context, r *pb.Rollout) (*pb.Rollout, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeSign(r.SignId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sign id %d", r.SignId)
+	}
+	if r.RevisionId != 0 && s.revision(r.SignId, r.RevisionId) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "sign %d has no revision %d", r.SignId, r.RevisionId)
+	}
+	if err := checkStages(r.Stages); err != nil {
+		return nil, err
+	}
+	kioskIDs := []int32{}
+	seen := make(map[int32]bool)
+	for _, kioskID := range r.KioskIds {
+		if s.activeKiosk(kioskID) == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid kiosk id %d", kioskID)
+		}
+		if !seen[kioskID] {
+			kioskIDs = append(kioskIDs, kioskID)
+			seen[kioskID] = true
+		}
+	}
+	if len(r.KioskIds) == 0 {
+		var kioskID int32
+		for kioskID = 1; kioskID < s.nextKioskId; kioskID++ {
+			if s.activeKiosk(kioskID) != nil {
+				kioskIDs = append(kioskIDs, kioskID)
+			}
+		}
+		// Early stages go to a random sample of the fleet.
+		rand.Shuffle(len(kioskIDs), func(i, j int) {
+			kioskIDs[i], kioskIDs[j] = kioskIDs[j], kioskIDs[i]
+		})
+	}
+	ro := &rollout{
+		Rollout: &pb.Rollout{
+			Id:         s.nextRolloutId,
+			SignId:     r.SignId,
+			RevisionId: r.RevisionId,
+			KioskIds:   kioskIDs,
+			Stages:     r.Stages,
+			CreateTime: timestamppb.Now(),
+			Creator:    Principal(c),
+		},
+		previous: make(map[int32]assignment),
+	}
+	s.nextRolloutId++
+	s.rollouts[ro.Id] = ro
+	s.startStage(c, "CreateRollout", r, ro, 0)
+	for _, kioskID := range ro.KioskIds[ro.UpdatedKioskCount:] {
+		s.sendToSessions(kioskID, s.prefetchHint(ro.SignId, ro.RevisionId))
+	}
+	s.audit(c, "CreateRollout", rolloutName(ro.Id), r, nil, ro.Rollout)
+	return proto.Clone(ro.Rollout).(*pb.Rollout), nil
+}
+
+// ListRollouts returns all rollouts.
+func (s *DisplayServer) ListRollouts(c context.Context, r *pb.ListRolloutsRequest) (*pb.ListRolloutsResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	response := &pb.ListRolloutsResponse{}
+	var id int32
+	for id = 1; id < s.nextRolloutId; id++ {
+		if ro := s.rollouts[id]; ro != nil {
+			response.Rollouts = append(response.Rollouts, proto.Clone(ro.Rollout).(*pb.Rollout))
+		}
+	}
+	return response, nil
+}
+
+// GetRollout returns the rollout with ID r.Id.
+func (s *DisplayServer) GetRollout(c context.Context, r *pb.GetRolloutRequest) (*pb.Rollout, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ro := s.rollouts[r.Id]
+	if ro == nil {
+		return nil, status.Errorf(codes.NotFound, "invalid rollout id %d", r.Id)
+	}
+	return proto.Clone(ro.Rollout).(*pb.Rollout), nil
+}
+
+// changeRollout applies a change to the rollout with ID id if it is in one
+// of the given states, and audits it. It must be called with s.mux held.
+func (s *DisplayServer) changeRollout(c context.Context, method string, r proto.Message, id int32, states []pb.Rollout_State, change func(ro *rollout)) (*pb.Rollout, error) {
+	ro := s.rollouts[id]
+	if ro == nil {
+		return nil, status.Errorf(codes.NotFound, "invalid rollout id %d", id)
+	}
+	allowed := false
+	for _, state := range states {
+		allowed = allowed || ro.State == state
+	}
+	if !allowed {
+		return nil, status.Errorf(codes.FailedPrecondition, "rollout %d is %s", id, ro.State)
+	}
+	before := proto.Clone(ro.Rollout)
+	change(ro)
+	s.audit(c, method, rolloutName(id), r, before, ro.Rollout)
+	return proto.Clone(ro.Rollout).(*pb.Rollout), nil
+}
+
+// AdvanceRollout starts the next stage of a rollout.
+func (s *DisplayServer) AdvanceRollout(c context.Context, r *pb.AdvanceRolloutRequest) (*pb.Rollout, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if ro := s.rollouts[r.Id]; ro != nil && s.activeSign(ro.SignId) == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "sign %d has been deleted", ro.SignId)
+	}
+	states := []pb.Rollout_State{pb.Rollout_RUNNING, pb.Rollout_AWAITING_APPROVAL}
+	return s.changeRollout(c, "AdvanceRollout", r, r.Id, states, func(ro *rollout) {
+		s.startStage(c, "AdvanceRollout", r, ro, int(ro.CurrentStage)+1)
+	})
+}
+
+// PauseRollout stops a rollout from advancing.
+func (s *DisplayServer) PauseRollout(c context.Context, r *pb.PauseRolloutRequest) (*pb.Rollout, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	states := []pb.Rollout_State{pb.Rollout_RUNNING, pb.Rollout_AWAITING_APPROVAL}
+	return s.changeRollout(c, "PauseRollout", r, r.Id, states, func(ro *rollout) {
+		ro.State = pb.Rollout_PAUSED
+		ro.NextStageTime = nil
+	})
+}
+
+// ResumeRollout lets a paused rollout advance again. The wait for the next
+// stage starts over.
+func (s *DisplayServer) ResumeRollout(c context.Context, r *pb.ResumeRolloutRequest) (*pb.Rollout, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	states := []pb.Rollout_State{pb.Rollout_PAUSED}
+	return s.changeRollout(c, "ResumeRollout", r, r.Id, states, s.waitForNextStage)
+}
+
+// AbortRollout stops a rollout and restores the previous signs of the
+// kiosks that it changed. Kiosks that have been set to another sign since
+// are left alone.
+func (s *DisplayServer) AbortRollout(c context.Context, r *pb.AbortRolloutRequest) (*pb.Rollout, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	states := []pb.Rollout_State{
+		pb.Rollout_RUNNING, pb.Rollout_AWAITING_APPROVAL, pb.Rollout_PAUSED, pb.Rollout_SUCCEEDED,
+	}
+	return s.changeRollout(c, "AbortRollout", r, r.Id, states, func(ro *rollout) {
+		kioskIDs := make(map[assignment][]int32)
+		order := []assignment{}
+		for _, kioskID := range ro.KioskIds[:ro.UpdatedKioskCount] {
+			previous, ok := ro.previous[kioskID]
+			current := s.assignment(kioskID)
+			if !ok || s.activeKiosk(kioskID) == nil ||
+				current.signID != ro.SignId || current.revisionID != ro.RevisionId {
+				continue
+			}
+			if kioskIDs[previous] == nil {
+				order = append(order, previous)
+			}
+			kioskIDs[previous] = append(kioskIDs[previous], kioskID)
+		}
+		for _, previous := range order {
+			s.assignSign(c, "AbortRollout", r, kioskIDs[previous], previous.signID, previous.revisionID)
+		}
+		ro.State = pb.Rollout_ABORTED
+		ro.NextStageTime = nil
+	})
+}
+
+// advanceRollouts starts the next stage of running rollouts whose wait has
+// passed. Rollouts of deleted signs wait until the sign is undeleted.
+func (s *DisplayServer) advanceRollouts(now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for id, ro := range s.rollouts {
+		if ro.State == pb.Rollout_RUNNING && !ro.NextStageTime.AsTime().After(now) && s.activeSign(ro.SignId) != nil {
+			r := &pb.AdvanceRolloutRequest{Id: id}
+			s.changeRollout(context.Background(), "AdvanceRollout", r, id, []pb.Rollout_State{pb.Rollout_RUNNING}, func(ro *rollout) {
+				s.startStage(context.Background(), "AdvanceRollout", r, ro, int(ro.CurrentStage)+1)
+			})
+		}
+	}
+}
+
+// RunRollouts advances running rollouts every interval until ctx is done.
+func (s *DisplayServer) RunRollouts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.advanceRollouts(now)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// UploadScreenshot stores a screenshot of a kiosk, forgetting the kiosk's
+// oldest screenshot if it has too many. It returns the screenshot without
+// its image.
+func (s *DisplayServer) UploadScreenshot(c context.Context, r *pb.Screenshot) (*pb.Screenshot, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeKiosk(r.KioskId) == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	return s.uploadScreenshot(r.KioskId, r)
+}
+
+// uploadScreenshot stores a screenshot as described by UploadScreenshot. It
+// must be called with s.mux held.
+func (s *DisplayServer) uploadScreenshot(kioskID int32, r *pb.Screenshot) (*pb.Screenshot, error) {
+	if len(r.Image) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "an image is required")
+	}
+	now := time.Now()
+	captureTime := timestamppb.New(now)
+	if r.CaptureTime != nil {
+		if r.CaptureTime.CheckValid() != nil || r.CaptureTime.AsTime().After(now.Add(maxClockSkew)) {
+			return nil, status.Error(codes.InvalidArgument, "capture_time must be valid and not in the future")
+		}
+		captureTime = r.CaptureTime
+	}
+	var command *pb.KioskCommand
+	if r.CommandId != 0 {
+		var err error
+		if command, err = s.command(kioskID, r.CommandId); err != nil {
+			return nil, err
+		}
+		if command.Type != pb.KioskCommand_SCREENSHOT {
+			return nil, status.Errorf(codes.InvalidArgument, "command %d is not a screenshot command", command.Id)
+		}
+		if finished(command) {
+			return nil, status.Errorf(codes.FailedPrecondition, "command %d is %s", command.Id, command.State)
+		}
+	}
+	// Forget the oldest screenshots that the new one replaces before checking
+	// the quota, so that a kiosk at its limit can keep uploading.
+	screenshots := s.screenshots[kioskID]
+	kept := s.ScreenshotsPerKiosk - 1
+	if kept < 0 {
+		kept = 0
+	}
+	evicted := []*pb.Screenshot{}
+	if len(screenshots) > kept {
+		evicted = screenshots[:len(screenshots)-kept]
+		screenshots = screenshots[len(screenshots)-kept:]
+	}
+	if err := s.checkScreenshotQuota(kioskID, screenshots, r.Image); err != nil {
+		return nil, err
+	}
+	for _, screenshot := range evicted {
+		s.releaseImage(screenshot.ImageHash)
+	}
+	s.seen(kioskID, now)
+	screenshot := &pb.Screenshot{
+		Id:          s.nextScreenshotId,
+		KioskId:     kioskID,
+		CaptureTime: captureTime,
+		CommandId:   r.CommandId,
+		ImageHash:   s.retainImage(r.Image),
+	}
+	s.nextScreenshotId++
+	s.screenshots[kioskID] = append(screenshots, screenshot)
+	if command != nil {
+		command.State = pb.KioskCommand_SUCCEEDED
+		command.CompleteTime = timestamppb.New(now)
+	}
+	return proto.Clone(screenshot).(*pb.Screenshot), nil
+}
+
+// checkScreenshotQuota returns an error if a kiosk that keeps some of its
+// screenshots can't store another image without exceeding the screenshot
+// quota. Screenshots of deleted kiosks don't count. It must be called with
+// s.mux held.
+func (s *DisplayServer) checkScreenshotQuota(kioskID int32, kept []*pb.Screenshot, image []byte) error {
+	max := s.Quotas.MaxScreenshotBytes
+	if max <= 0 {
+		return nil
+	}
+	sizes := map[string]int64{imageHash(image): int64(len(image))}
+	for id, screenshots := range s.screenshots {
+		if id == kioskID {
+			screenshots = kept
+		} else if s.activeKiosk(id) == nil {
+			continue
+		}
+		for _, screenshot := range screenshots {
+			if stored := s.images[screenshot.ImageHash]; stored != nil {
+				sizes[screenshot.ImageHash] = int64(len(stored.data))
+			}
+		}
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	if total > max {
+		return resourceExhausted(quotaRetryDelay, "screenshots would exceed %d bytes", max)
+	}
+	return nil
+}
+
+// removeScreenshots removes the screenshots of a kiosk that is being purged.
+// It must be called with s.mux held.
+func (s *DisplayServer) removeScreenshots(kioskID int32) {
+	for _, screenshot := range s.screenshots[kioskID] {
+		s.releaseImage(screenshot.ImageHash)
+	}
+	delete(s.screenshots, kioskID)
+}
+
+// ListScreenshots returns the screenshots kept for the kiosk with ID
+// r.KioskId, newest first and without their images.
+func (s *DisplayServer) ListScreenshots(c context.Context, r *pb.ListScreenshotsRequest) (*pb.ListScreenshotsResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.kiosks[r.KioskId] == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	response := &pb.ListScreenshotsResponse{}
+	screenshots := s.screenshots[r.KioskId]
+	for i := len(screenshots) - 1; i >= 0; i-- {
+		response.Screenshots = append(response.Screenshots, proto.Clone(screenshots[i]).(*pb.Screenshot))
+	}
+	return response, nil
+}
+
+// GetScreenshot returns the screenshot with ID r.Id of the kiosk with ID
+// r.KioskId, or its latest screenshot if r.Id is 0, with its image.
+func (s *DisplayServer) GetScreenshot(c context.Context, r *pb.GetScreenshotRequest) (*pb.Screenshot, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.kiosks[r.KioskId] == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	screenshots := s.screenshots[r.KioskId]
+	for i := len(screenshots) - 1; i >= 0; i-- {
+		if r.Id == 0 || screenshots[i].Id == r.Id {
+			screenshot := proto.Clone(screenshots[i]).(*pb.Screenshot)
+			if stored := s.images[screenshot.ImageHash]; stored != nil {
+				screenshot.Image = stored.data
+			}
+			return screenshot, nil
+		}
+	}
+	if r.Id == 0 {
+		return nil, status.Errorf(codes.NotFound, "kiosk %d has no screenshots", r.KioskId)
+	}
+	return nil, status.Errorf(codes.NotFound, "kiosk %d has no screenshot %d", r.KioskId, r.Id)
+}
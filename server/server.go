@@ -15,39 +15,207 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	pb "github.com/googleapis/kiosk/generated"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 const (
 	useSSL = false
 )
 
+var (
+	httpAddress     = flag.String("http", ":8081", "address of the REST/JSON gateway and gRPC-Web endpoint, or empty to disable them")
+	allowedOrigins  = flag.String("cors-allowed-origins", "", "comma-separated list of origins allowed to make gRPC-Web and watch requests, or * for any")
+	enableReflect   = flag.Bool("reflection", false, "enable gRPC server reflection")
+	healthInterval  = flag.Duration("health-interval", 5*time.Second, "how often to check the readiness of storage")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for requests to finish when shutting down")
+	adminAddress    = flag.String("admin", ":9090", "address of the admin server that publishes /metrics, or empty to disable it")
+	logLevel        = flag.String("log-level", "info", "minimum level of log records: debug, info, warn or error")
+	logFormat       = flag.String("log-format", "text", "format of log records: text or json")
+	traceExporter   = flag.String("trace-exporter", "", "where to export trace spans: stdout, otlp, or empty to disable tracing")
+	otlpEndpoint    = flag.String("otlp-endpoint", "localhost:4317", "address of the OpenTelemetry collector used by -trace-exporter=otlp")
+	auditLogPath    = flag.String("audit-log", "kiosk-audit.log", "file that records all changes, or empty to disable auditing")
+	auditMaxBytes   = flag.Int64("audit-max-bytes", 10<<20, "size at which the audit log is rotated")
+	auditMaxFiles   = flag.Int("audit-max-files", 10, "number of rotated audit log files to keep")
+	trustProxies    = flag.String("trusted-proxies", "", "comma-separated addresses or CIDR ranges of proxies, such as the Cloud Endpoints proxy, whose identity headers are trusted")
+	rateLimit       = flag.Float64("rate-limit", 0, "requests per second allowed from each principal, or 0 for no limit")
+	rateBurst       = flag.Int("rate-burst", 20, "requests that each principal may make in a burst")
+	maxKiosks       = flag.Int("max-kiosks", 0, "maximum number of kiosks, or 0 for no limit")
+	maxSigns        = flag.Int("max-signs", 0, "maximum number of signs, or 0 for no limit")
+	maxImageBytes   = flag.Int64("max-image-bytes", 0, "maximum total size of sign and template images, or 0 for no limit")
+	maxShotBytes    = flag.Int64("max-screenshot-bytes", 0, "maximum total size of screenshots, or 0 for no limit")
+	maxStreams      = flag.Int("max-streams-per-kiosk", 0, "maximum concurrent streams watching a kiosk, or 0 for no limit")
+	requestRetain   = flag.Duration("request-retention", time.Hour, "how long the ids of create requests and plays are remembered to detect retries")
+	deleteRetain    = flag.Duration("delete-retention", 7*24*time.Hour, "how long deleted kiosks and signs can be undeleted before they are purged")
+	heartbeat       = flag.Duration("heartbeat-timeout", 2*time.Minute, "how long a kiosk without a stream is online after reporting its status")
+	screenshotEvery = flag.Duration("screenshot-interval", 0, "how often kiosks with sessions upload screenshots, or 0 for only on request")
+	screenshotsKept = flag.Int("screenshots-per-kiosk", 5, "number of screenshots kept for each kiosk")
+)
+
 func main() {
-	var err error
+	flag.Parse()
+	logger, err := NewLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		log.Fatalf("failed to create logger: %v", err)
+	}
+	slog.SetDefault(logger)
+	shutdownTracing, err := InitTracing(context.Background(), *traceExporter, *otlpEndpoint)
+	if err != nil {
+		log.Fatalf("failed to initialize tracing: %v", err)
+	}
+	if err := SetTrustedProxies(*trustProxies); err != nil {
+		log.Fatalf("%v", err)
+	}
 	var lis net.Listener
 	var grpcServer *grpc.Server
+	var grpcAddress string
+	unaryInterceptors := []grpc.UnaryServerInterceptor{LoggingUnaryInterceptor, MetricsUnaryInterceptor}
+	streamInterceptors := []grpc.StreamServerInterceptor{LoggingStreamInterceptor, MetricsStreamInterceptor}
+	var limiter *RateLimiter
+	if *rateLimit > 0 {
+		limiter = NewRateLimiter(*rateLimit, *rateBurst)
+		unaryInterceptors = append(unaryInterceptors, limiter.UnaryInterceptor)
+		streamInterceptors = append(streamInterceptors, limiter.StreamInterceptor)
+	}
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	}
 	if !useSSL {
+		grpcAddress = "localhost:8080"
 		lis, err = net.Listen("tcp", ":8080")
 		if err != nil {
 			log.Fatalf("failed to listen: %v", err)
 		}
-		grpcServer = grpc.NewServer()
+		grpcServer = grpc.NewServer(opts...)
 	} else {
 		certFile := "ssl.crt"
 		keyFile := "ssl.key"
 		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+		grpcAddress = "localhost:443"
 		lis, err = net.Listen("tcp", ":443")
 		if err != nil {
 			log.Fatalf("failed to listen: %v", err)
 		}
-		grpcServer = grpc.NewServer(grpc.Creds(creds))
+		grpcServer = grpc.NewServer(append(opts, grpc.Creds(creds))...)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	displayServer := NewDisplayServer()
+	displayServer.Quotas = Quotas{
+		MaxKiosks:          *maxKiosks,
+		MaxSigns:           *maxSigns,
+		MaxImageBytes:      *maxImageBytes,
+		MaxScreenshotBytes: *maxShotBytes,
+		MaxStreamsPerKiosk: *maxStreams,
+	}
+	displayServer.RequestRetention = *requestRetain
+	displayServer.DeleteRetention = *deleteRetain
+	displayServer.HeartbeatTimeout = *heartbeat
+	displayServer.ScreenshotInterval = *screenshotEvery
+	displayServer.ScreenshotsPerKiosk = *screenshotsKept
+	go displayServer.RunPurger(ctx, time.Minute)
+	go displayServer.RunRollouts(ctx, time.Second)
+	if *auditLogPath != "" {
+		displayServer.AuditLog, err = OpenAuditLog(*auditLogPath, *auditMaxBytes, *auditMaxFiles)
+		if err != nil {
+			log.Fatalf("failed to open audit log: %v", err)
+		}
+		defer displayServer.AuditLog.Close()
+	}
 	pb.RegisterDisplayServer(grpcServer, displayServer)
-	grpcServer.Serve(lis)
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	go reportHealth(ctx, healthServer, displayServer, *healthInterval)
+	if *enableReflect {
+		reflection.Register(grpcServer)
+	}
+	if *adminAddress != "" {
+		RegisterMetrics(displayServer)
+		admin := http.NewServeMux()
+		admin.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminAddress, admin))
+		}()
+	}
+	var httpServer *http.Server
+	if *httpAddress != "" {
+		gateway, err := NewGateway(ctx, grpcAddress)
+		if err != nil {
+			log.Fatalf("failed to create gateway: %v", err)
+		}
+		allowed := originAllowed(*allowedOrigins)
+		if err := gateway.HandlePath("GET", watchPath, displayServer.WatchSign(allowed, limiter)); err != nil {
+			log.Fatalf("failed to register %s: %v", watchPath, err)
+		}
+		httpServer = &http.Server{
+			Addr:    *httpAddress,
+			Handler: NewWebHandler(grpcServer, gateway, allowed),
+		}
+		go func() {
+			if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("failed to serve http: %v", err)
+			}
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		slog.Info("shutting down", "signal", sig.String())
+		shutdown(grpcServer, httpServer, healthServer, displayServer, *shutdownTimeout)
+		close(stopped)
+	}()
+	if err := grpcServer.Serve(lis); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+	<-stopped
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("failed to flush trace spans", "error", err)
+	}
+}
+
+// shutdown stops the servers gracefully. Health checks fail immediately so
+// that no new work is routed here, streaming kiosks are told to reconnect,
+// and in-flight requests have until timeout to finish.
+func shutdown(grpcServer *grpc.Server, httpServer *http.Server, healthServer *health.Server, displayServer *DisplayServer, timeout time.Duration) {
+	healthServer.Shutdown()
+	displayServer.Drain()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			slog.Warn("http shutdown", "error", err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("requests did not finish in time, stopping", "timeout", timeout)
+		grpcServer.Stop()
+	}
 }
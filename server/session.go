@@ -0,0 +1,266 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	pb "github.com/googleapis/kiosk/generated"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// sessionBuffer is how many messages other than sign changes may wait to be
+// sent to a session before it is ended for falling behind.
+const sessionBuffer = 64
+
+// openSession registers a channel that receives messages other than sign
+// changes for the sessions of a kiosk. It must be called with s.mux held.
+func (s *DisplayServer) openSession(kioskID int32) chan *pb.KioskSessionResponse {
+	ch := make(chan *pb.KioskSessionResponse, sessionBuffer)
+	if s.sessions[kioskID] == nil {
+		s.sessions[kioskID] = make(map[chan *pb.KioskSessionResponse]bool)
+	}
+	s.sessions[kioskID][ch] = true
+	return ch
+}
+
+// closeSession removes the channels that a session registered with
+// subscribe and openSession. Like unsubscribe, it acquires s.mux itself.
+func (s *DisplayServer) closeSession(kioskID int32, updates chan signUpdate, messages chan *pb.KioskSessionResponse) {
+	s.mux.Lock()
+	delete(s.subscribers[kioskID], updates)
+	delete(s.sessions[kioskID], messages)
+	if len(s.sessions[kioskID]) == 0 {
+		delete(s.sessions, kioskID)
+	}
+	s.seen(kioskID, time.Now())
+	s.mux.Unlock()
+}
+
+// sendToSessions sends a message to the sessions of a kiosk without waiting
+// for them. A session whose buffer is full is closed, so that the kiosk
+// reconnects and catches up, rather than holding up the server. It returns
+// the number of sessions that the message was sent to and must be called
+// with s.mux held.
+func (s *DisplayServer) sendToSessions(kioskID int32, m *pb.KioskSessionResponse) int {
+	sent := 0
+	for ch := range s.sessions[kioskID] {
+		select {
+		case ch <- m:
+			sent++
+		default:
+			delete(s.sessions[kioskID], ch)
+			close(ch)
+		}
+	}
+	return sent
+}
+
+// kioskConfig returns the configuration of a kiosk for its sessions. It must
+// be called with s.mux held.
+func (s *DisplayServer) kioskConfig(kioskID int32) *pb.KioskSessionResponse {
+	config := &pb.KioskConfig{
+		Kiosk:             s.withStatus(s.kiosks[kioskID], time.Now()),
+		HeartbeatInterval: durationpb.New(s.HeartbeatTimeout / 2),
+	}
+	if s.ScreenshotInterval > 0 {
+		config.ScreenshotInterval = durationpb.New(s.ScreenshotInterval)
+	}
+	return &pb.KioskSessionResponse{Message: &pb.KioskSessionResponse_Config{Config: config}}
+}
+
+// prefetchHint returns a hint to fetch a revision of a sign, or the latest
+// revision if revisionID is 0. It must be called with s.mux held.
+func (s *DisplayServer) prefetchHint(signID int32, revisionID int32) *pb.KioskSessionResponse {
+	hint := &pb.PrefetchHint{SignId: signID, RevisionId: revisionID}
+	if revision := s.revision(signID, revisionID); revision != nil {
+		hint.ImageHash = revision.ImageHash
+	} else if sign := s.signs[signID]; sign != nil {
+		hint.RevisionId, hint.ImageHash = sign.RevisionId, sign.ImageHash
+	}
+	return &pb.KioskSessionResponse{Message: &pb.KioskSessionResponse_Prefetch{Prefetch: hint}}
+}
+
+// prefetchHints returns hints for the signs of rollouts that haven't yet
+// reached a kiosk. It must be called with s.mux held.
+func (s *DisplayServer) prefetchHints(kioskID int32) []*pb.KioskSessionResponse {
+	hints := []*pb.KioskSessionResponse{}
+	var id int32
+	for id = 1; id < s.nextRolloutId; id++ {
+		ro := s.rollouts[id]
+		if ro == nil || (ro.State != pb.Rollout_RUNNING && ro.State != pb.Rollout_AWAITING_APPROVAL && ro.State != pb.Rollout_PAUSED) {
+			continue
+		}
+		for _, pending := range ro.KioskIds[ro.UpdatedKioskCount:] {
+			if pending == kioskID {
+				hints = append(hints, s.prefetchHint(ro.SignId, ro.RevisionId))
+			}
+		}
+	}
+	return hints
+}
+
+// signChanged tells the sessions of kiosks that show the latest revision of
+// a sign to fetch its new revision. It must be called with s.mux held.
+func (s *DisplayServer) signChanged(sign *pb.Sign) {
+	for kioskID, signID := range s.signIdsForKioskIds {
+		if signID == sign.Id && s.revisionIdsForKioskIds[kioskID] == 0 {
+			s.sendToSessions(kioskID, s.prefetchHint(sign.Id, 0))
+		}
+	}
+}
+
+// KioskSession connects a kiosk to the server. The kiosk must start with a
+// hello, after which the server sends the kiosk's configuration, its
+// current sign unless the kiosk already shows it, the signs of the regions
+// of its layout if it asks for them, hints for signs that it will show soon
+// and queued commands. Then each side sends messages as
+// things happen. An invalid message from the kiosk ends the session with an
+// error, and a kiosk that falls behind is asked to reconnect.
+func (s *DisplayServer) KioskSession(stream pb.Display_KioskSessionServer) error {
+	ctx := stream.Context()
+	m, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := m.GetHello()
+	if hello == nil {
+		return status.Error(codes.InvalidArgument, "a session must start with a hello")
+	}
+	kioskID := hello.KioskId
+	s.mux.Lock()
+	if s.activeKiosk(kioskID) == nil {
+		s.mux.Unlock()
+		return errors.New("invalid kiosk id")
+	}
+	if err := s.checkStreamQuota(kioskID); err != nil {
+		s.mux.Unlock()
+		return err
+	}
+	initial := []*pb.KioskSessionResponse{s.kioskConfig(kioskID)}
+	if current := s.signIdResponse(kioskID); current.Etag != hello.AssignmentEtag {
+		initial = append(initial, &pb.KioskSessionResponse{
+			Message: &pb.KioskSessionResponse_Assignment{Assignment: current},
+		})
+	}
+	if hello.IncludeRegions {
+		for _, update := range s.regionUpdates(kioskID) {
+			initial = append(initial, &pb.KioskSessionResponse{
+				Message: &pb.KioskSessionResponse_Assignment{Assignment: update.response()},
+			})
+		}
+	}
+	initial = append(initial, s.prefetchHints(kioskID)...)
+	for _, command := range s.queuedCommands(kioskID) {
+		initial = append(initial, commandMessage(command))
+	}
+	updates := s.subscribe(kioskID, subscription{regions: hello.IncludeRegions})
+	messages := s.openSession(kioskID)
+	s.mux.Unlock()
+	defer s.closeSession(kioskID, updates, messages)
+	for _, m := range initial {
+		if err := stream.Send(m); err != nil {
+			return err
+		}
+		s.delivered(kioskID, m.GetCommand())
+	}
+	received := make(chan error, 1)
+	go func() {
+		for {
+			m, err := stream.Recv()
+			if err == nil {
+				err = s.handleSessionRequest(kioskID, m)
+			}
+			if err != nil {
+				received <- err
+				return
+			}
+		}
+	}()
+	timer := time.NewTimer(s.SessionLifetime)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case <-s.draining:
+			return errDraining
+		case err := <-received:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case update := <-updates:
+			err := stream.Send(&pb.KioskSessionResponse{
+				Message: &pb.KioskSessionResponse_Assignment{Assignment: update.response()},
+			})
+			if err != nil {
+				slog.WarnContext(ctx, "failed to send sign", "kiosk_id", kioskID, "error", err)
+				return err
+			}
+			observeFanout(update)
+		case m, ok := <-messages:
+			if !ok {
+				return status.Error(codes.Unavailable, "the session fell behind; reconnect")
+			}
+			if err := stream.Send(m); err != nil {
+				return err
+			}
+			s.delivered(kioskID, m.GetCommand())
+		}
+	}
+}
+
+// handleSessionRequest handles a message that a kiosk sent after its hello.
+func (s *DisplayServer) handleSessionRequest(kioskID int32, m *pb.KioskSessionRequest) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	switch m := m.Message.(type) {
+	case *pb.KioskSessionRequest_Heartbeat:
+		s.seen(kioskID, time.Now())
+	case *pb.KioskSessionRequest_Status:
+		if m.Status.KioskId != 0 && m.Status.KioskId != kioskID {
+			return status.Errorf(codes.InvalidArgument, "status is for kiosk %d, not %d", m.Status.KioskId, kioskID)
+		}
+		s.reportStatus(kioskID, m.Status)
+	case *pb.KioskSessionRequest_Plays:
+		if m.Plays.KioskId != 0 && m.Plays.KioskId != kioskID {
+			return status.Errorf(codes.InvalidArgument, "plays are for kiosk %d, not %d", m.Plays.KioskId, kioskID)
+		}
+		return s.reportPlays(kioskID, m.Plays.Events)
+	case *pb.KioskSessionRequest_CommandResult:
+		if m.CommandResult.KioskId != 0 && m.CommandResult.KioskId != kioskID {
+			return status.Errorf(codes.InvalidArgument, "command result is for kiosk %d, not %d", m.CommandResult.KioskId, kioskID)
+		}
+		_, err := s.reportCommandResult(kioskID, m.CommandResult)
+		return err
+	case *pb.KioskSessionRequest_Screenshot:
+		if m.Screenshot.KioskId != 0 && m.Screenshot.KioskId != kioskID {
+			return status.Errorf(codes.InvalidArgument, "screenshot is for kiosk %d, not %d", m.Screenshot.KioskId, kioskID)
+		}
+		_, err := s.uploadScreenshot(kioskID, m.Screenshot)
+		return err
+	case *pb.KioskSessionRequest_Hello:
+		return status.Error(codes.InvalidArgument, "a session has only one hello")
+	default:
+		return status.Error(codes.InvalidArgument, "empty or unknown message")
+	}
+	return nil
+}
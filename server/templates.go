@@ -0,0 +1,347 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	pb "github.com/googleapis/kiosk/generated"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// variableReference matches a variable in the text of a template.
+	variableReference = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+	// variableName matches the names of variables.
+	variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// templateName returns the audit resource name of a sign template.
+func templateName(id int32) string {
+	return fmt.Sprintf("signTemplates/%d", id)
+}
+
+// checkVariables returns an error if the name of a variable is invalid.
+func checkVariables(variables map[string]string) error {
+	for name := range variables {
+		if !variableName.MatchString(name) {
+			return status.Errorf(codes.InvalidArgument, "invalid variable name %q", name)
+		}
+	}
+	return nil
+}
+
+// sameVariables returns true if two sets of variables are the same.
+func sameVariables(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// checkOverlays returns an error if an overlay is off the screen.
+func checkOverlays(overlays []*pb.TextOverlay) error {
+	for i, overlay := range overlays {
+		if overlay.X < 0 || overlay.X > 1 || overlay.Y < 0 || overlay.Y > 1 {
+			return itemError("overlays", i, status.Error(codes.InvalidArgument, "x and y must be between 0 and 1"))
+		}
+	}
+	return nil
+}
+
+// fillIn replaces the variables in text with the first of the sets of
+// variables that has them. Unknown variables are left as they are.
+func fillIn(text string, variables ...map[string]string) string {
+	return variableReference.ReplaceAllStringFunc(text, func(reference string) string {
+		name := variableReference.FindStringSubmatch(reference)[1]
+		for _, values := range variables {
+			if value, ok := values[name]; ok {
+				return value
+			}
+		}
+		return reference
+	})
+}
+
+// checkSignTemplate returns an error if a sign's template is invalid or if
+// a sign with a template has its own content. It must be called with s.mux
+// held.
+func (s *DisplayServer) checkSignTemplate(sign *pb.Sign) error {
+	if sign.TemplateId == 0 {
+		return nil
+	}
+	if s.templates[sign.TemplateId] == nil {
+		return status.Errorf(codes.InvalidArgument, "invalid template id %d", sign.TemplateId)
+	}
+	if sign.Text != "" || len(sign.Image) > 0 {
+		return status.Error(codes.InvalidArgument, "a sign with a template has no text or image of its own")
+	}
+	return nil
+}
+
+// templateVariables returns the variables of a kiosk for a sign, in order
+// of precedence. It must be called with s.mux held.
+func (s *DisplayServer) templateVariables(kioskID int32, signID int32) []map[string]string {
+	return []map[string]string{
+		s.variablesForKioskIds[kioskID][signID],
+		s.kiosks[kioskID].GetVariables(),
+	}
+}
+
+// setAssignmentVariables sets the variables of a sign on a kiosk and
+// returns true if they changed. It must be called with s.mux held.
+func (s *DisplayServer) setAssignmentVariables(kioskID int32, signID int32, variables map[string]string) bool {
+	if sameVariables(s.variablesForKioskIds[kioskID][signID], variables) {
+		return false
+	}
+	if len(variables) == 0 {
+		delete(s.variablesForKioskIds[kioskID], signID)
+		if len(s.variablesForKioskIds[kioskID]) == 0 {
+			delete(s.variablesForKioskIds, kioskID)
+		}
+		return true
+	}
+	if s.variablesForKioskIds[kioskID] == nil {
+		s.variablesForKioskIds[kioskID] = make(map[int32]map[string]string)
+	}
+	s.variablesForKioskIds[kioskID][signID] = variables
+	return true
+}
+
+// refreshKiosks sends the assignments of kiosks, and those of the regions
+// of their layouts, again, with new etags, so that they fetch their
+// effective signs again. It must be called with s.mux held.
+func (s *DisplayServer) refreshKiosks(kioskIDs []int32) {
+	for _, kioskID := range kioskIDs {
+		update := s.setSignIdForKioskId(kioskID, s.signIdsForKioskIds[kioskID], s.revisionIdsForKioskIds[kioskID])
+		s.notify(kioskID, update)
+		s.sendRegions(kioskID)
+	}
+}
+
+// kiosksShowing returns the active kiosks that show a sign, on the whole
+// screen or in a region, that satisfies shows. It must be called with
+// s.mux held.
+func (s *DisplayServer) kiosksShowing(shows func(sign *pb.Sign) bool) []int32 {
+	kioskIDs := []int32{}
+	var kioskID int32
+	for kioskID = 1; kioskID < s.nextKioskId; kioskID++ {
+		if s.activeKiosk(kioskID) == nil {
+			continue
+		}
+		for _, shown := range s.shownSigns(kioskID) {
+			if sign := s.signs[shown.signID]; sign != nil && shows(sign) {
+				kioskIDs = append(kioskIDs, kioskID)
+				break
+			}
+		}
+	}
+	return kioskIDs
+}
+
+// CreateSignTemplate creates a sign template.
+func (s *DisplayServer) CreateSignTemplate(c context.Context, r *pb.SignTemplate) (*pb.SignTemplate, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := checkOverlays(r.Overlays); err != nil {
+		return nil, err
+	}
+	if err := s.checkImageQuota(r.Image); err != nil {
+		return nil, err
+	}
+	template := &pb.SignTemplate{
+		Id:         s.nextTemplateId,
+		Name:       r.Name,
+		Text:       r.Text,
+		Image:      r.Image,
+		Overlays:   r.Overlays,
+		ImageHash:  s.retainImage(r.Image),
+		CreateTime: timestamppb.Now(),
+		Etag:       s.newEtag(),
+	}
+	s.nextTemplateId++
+	s.templates[template.Id] = template
+	s.audit(c, "CreateSignTemplate", templateName(template.Id), r, nil, template)
+	return template, nil
+}
+
+// ListSignTemplates returns all sign templates.
+func (s *DisplayServer) ListSignTemplates(c context.Context, r *google_protobuf.Empty) (*pb.ListSignTemplatesResponse, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	response := &pb.ListSignTemplatesResponse{}
+	var id int32
+	for id = 1; id < s.nextTemplateId; id++ {
+		if template := s.templates[id]; template != nil {
+			response.Templates = append(response.Templates, template)
+		}
+	}
+	return response, nil
+}
+
+// GetSignTemplate returns the sign template with ID r.Id.
+func (s *DisplayServer) GetSignTemplate(c context.Context, r *pb.GetSignTemplateRequest) (*pb.SignTemplate, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	template := s.templates[r.Id]
+	if template == nil {
+		return nil, status.Errorf(codes.NotFound, "invalid template id %d", r.Id)
+	}
+	return template, nil
+}
+
+// UpdateSignTemplate replaces the sign template with ID r.Id, and sends
+// the assignments of kiosks that show signs made from it again.
+func (s *DisplayServer) UpdateSignTemplate(c context.Context, r *pb.SignTemplate) (*pb.SignTemplate, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	old := s.templates[r.Id]
+	if old == nil {
+		return nil, status.Errorf(codes.NotFound, "invalid template id %d", r.Id)
+	}
+	if err := checkEtag(templateName(r.Id), r.Etag, old.Etag); err != nil {
+		return nil, err
+	}
+	if err := checkOverlays(r.Overlays); err != nil {
+		return nil, err
+	}
+	if err := s.checkImageQuota(r.Image); err != nil {
+		return nil, err
+	}
+	updated := &pb.SignTemplate{
+		Id:         old.Id,
+		Name:       r.Name,
+		Text:       r.Text,
+		Image:      r.Image,
+		Overlays:   r.Overlays,
+		ImageHash:  s.retainImage(r.Image),
+		CreateTime: old.CreateTime,
+		Etag:       s.newEtag(),
+	}
+	s.releaseImage(old.ImageHash)
+	s.templates[r.Id] = updated
+	s.audit(c, "UpdateSignTemplate", templateName(r.Id), r, old, updated)
+	s.refreshKiosks(s.kiosksShowing(func(sign *pb.Sign) bool {
+		return sign.TemplateId == r.Id
+	}))
+	return updated, nil
+}
+
+// DeleteSignTemplate deletes the sign template with ID r.Id. Templates that
+// signs are made from can't be deleted, even if the signs are deleted,
+// until the signs have been purged.
+func (s *DisplayServer) DeleteSignTemplate(c context.Context, r *pb.DeleteSignTemplateRequest) (*google_protobuf.Empty, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	template := s.templates[r.Id]
+	if template == nil {
+		return nil, status.Errorf(codes.NotFound, "invalid template id %d", r.Id)
+	}
+	if err := checkEtag(templateName(r.Id), r.Etag, template.Etag); err != nil {
+		return nil, err
+	}
+	for _, sign := range s.signs {
+		if sign.TemplateId == r.Id {
+			return nil, status.Errorf(codes.FailedPrecondition, "sign %d is made from template %d", sign.Id, r.Id)
+		}
+	}
+	s.releaseImage(template.ImageHash)
+	delete(s.templates, r.Id)
+	s.audit(c, "DeleteSignTemplate", templateName(r.Id), r, template, nil)
+	return &google_protobuf.Empty{}, nil
+}
+
+// effectiveSign returns the content that a kiosk should display for a
+// sign, with template variables and then values from the data feed filled
+// in, or nil if there is no such sign. It must be called with s.mux held.
+func (s *DisplayServer) effectiveSign(kioskID int32, signID int32, revisionID int32) *pb.Sign {
+	sign := s.signs[signID]
+	if sign == nil {
+		return nil
+	}
+	effective := &pb.Sign{
+		Id:         sign.Id,
+		Name:       sign.Name,
+		CreateTime: sign.CreateTime,
+		DeleteTime: sign.DeleteTime,
+		ExpireTime: sign.ExpireTime,
+		RevisionId: sign.RevisionId,
+		TemplateId: sign.TemplateId,
+	}
+	if template := s.templates[sign.TemplateId]; template != nil {
+		variables := s.templateVariables(kioskID, sign.Id)
+		effective.Text = s.fillInData(fillIn(template.Text, variables...))
+		effective.Image = template.Image
+		effective.ImageHash = template.ImageHash
+		for _, overlay := range template.Overlays {
+			effective.Overlays = append(effective.Overlays, &pb.TextOverlay{
+				Text: s.fillInData(fillIn(overlay.Text, variables...)),
+				X:    overlay.X,
+				Y:    overlay.Y,
+			})
+		}
+		return effective
+	}
+	if revisionID != 0 {
+		effective.RevisionId = revisionID
+	}
+	if revision := s.revision(sign.Id, effective.RevisionId); revision != nil {
+		effective.Text = s.fillInData(revision.Text)
+		effective.ImageHash = revision.ImageHash
+		if stored := s.images[revision.ImageHash]; stored != nil {
+			effective.Image = stored.data
+		}
+	}
+	return effective
+}
+
+// GetEffectiveSign returns the content that the kiosk with ID r.KioskId
+// should display on the whole screen or, if r.Region is set, in a region
+// of its layout.
+func (s *DisplayServer) GetEffectiveSign(c context.Context, r *pb.GetEffectiveSignRequest) (*pb.Sign, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.activeKiosk(r.KioskId) == nil {
+		return nil, errors.New("invalid kiosk id")
+	}
+	signID := s.signIdsForKioskIds[r.KioskId]
+	revisionID := s.revisionIdsForKioskIds[r.KioskId]
+	if r.Region != "" {
+		kl := s.layoutsForKioskIds[r.KioskId]
+		if kl == nil || !hasRegion(s.layouts[kl.layoutID], r.Region) {
+			return nil, status.Errorf(codes.InvalidArgument, "kiosk %d has no region %q", r.KioskId, r.Region)
+		}
+		if regionSignID := s.regionSignId(r.KioskId, r.Region); regionSignID != 0 {
+			signID, revisionID = regionSignID, 0
+		}
+	}
+	effective := s.effectiveSign(r.KioskId, signID, revisionID)
+	if effective == nil {
+		return nil, status.Errorf(codes.NotFound, "kiosk %d has no sign", r.KioskId)
+	}
+	return proto.Clone(effective).(*pb.Sign), nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"nhooyr.io/websocket"
+)
+
+// watchPath is the HTTP path that streams sign changes for a kiosk.
+const watchPath = "/v1/kiosks/{kiosk_id}/sign:watch"
+
+// eventMarshaler encodes the data of each watch event on a single line.
+var eventMarshaler = protojson.MarshalOptions{EmitUnpopulated: true}
+
+// A watchEvent is the WebSocket message for a sign change. Server-Sent Events
+// carry the same values in their id and data fields.
+type watchEvent struct {
+	ID   int64           `json:"id,omitempty"` // unset for commands
+	Data json.RawMessage `json:"data"`
+}
+
+// WatchSign returns a handler for watchPath that streams sign changes as
+// Server-Sent Events, or as WebSocket messages when the request asks to
+// upgrade. Clients that reconnect with the Last-Event-ID header (or the
+// last_event_id query parameter, since browsers can't set headers on
+// WebSockets) only receive the current sign if it changed since that event.
+// The signs of the regions of the kiosk's layout are only sent if the
+// include_regions query parameter is true, and the kiosk's commands only if
+// include_commands is true. Requests from origins that
+// aren't allowed are refused, and allowed ones are answered with CORS
+// headers so that browsers can use EventSource. Requests count against the
+// rate limit of their principal, if limiter is not nil, like gRPC requests.
+func (s *DisplayServer) WatchSign(allowed func(origin string) bool, limiter *RateLimiter) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if limiter != nil {
+			if err := limiter.Allow(HTTPPrincipal(r)); err != nil {
+				tooManyRequests(w, err)
+				return
+			}
+		}
+		id, err := strconv.ParseInt(params["kiosk_id"], 10, 32)
+		if err != nil {
+			http.Error(w, "invalid kiosk id", http.StatusBadRequest)
+			return
+		}
+		kioskID := int32(id)
+		lastEventID := int64(-1)
+		last := r.Header.Get("Last-Event-ID")
+		if last == "" {
+			last = r.URL.Query().Get("last_event_id")
+		}
+		if last != "" {
+			lastEventID, err = strconv.ParseInt(last, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid last event id", http.StatusBadRequest)
+				return
+			}
+		}
+		var sub subscription
+		for name, value := range map[string]*bool{"include_regions": &sub.regions, "include_commands": &sub.commands} {
+			if include := r.URL.Query().Get(name); include != "" {
+				if *value, err = strconv.ParseBool(include); err != nil {
+					http.Error(w, "invalid "+name, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		s.mux.Lock()
+		exists := s.activeKiosk(kioskID) != nil
+		quotaErr := s.checkStreamQuota(kioskID)
+		s.mux.Unlock()
+		if !exists {
+			http.Error(w, "invalid kiosk id", http.StatusNotFound)
+			return
+		}
+		if quotaErr != nil {
+			tooManyRequests(w, quotaErr)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		if !allowed(origin) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			s.watchSignWebSocket(w, r, kioskID, lastEventID, sub)
+		} else {
+			if origin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			s.watchSignEvents(w, r, kioskID, lastEventID, sub)
+		}
+	}
+}
+
+// tooManyRequests answers a request that exceeded a limit with the message
+// of err, and with the retry delay of err, if it has one, in Retry-After.
+func tooManyRequests(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	delay := quotaRetryDelay
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			delay = info.RetryDelay.AsDuration()
+		}
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	http.Error(w, st.Message(), http.StatusTooManyRequests)
+}
+
+// watchSignEvents streams sign changes as Server-Sent Events. Commands have
+// no event id, so they don't change the id that a client resumes from.
+func (s *DisplayServer) watchSignEvents(w http.ResponseWriter, r *http.Request, kioskID int32, lastEventID int64, sub subscription) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	s.watch(r.Context(), kioskID, lastEventID, sub, func(update signUpdate) error {
+		data, err := eventMarshaler.Marshal(update.response())
+		if err != nil {
+			return err
+		}
+		if update.command == nil {
+			if _, err = fmt.Fprintf(w, "id: %d\n", update.eventID); err != nil {
+				return err
+			}
+		}
+		if _, err = fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+}
+
+// watchSignWebSocket streams sign changes as WebSocket text messages.
+func (s *DisplayServer) watchSignWebSocket(w http.ResponseWriter, r *http.Request, kioskID int32, lastEventID int64, sub subscription) {
+	// The origin has already been checked by WatchSign.
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		return
+	}
+	defer c.Close(websocket.StatusInternalError, "")
+	ctx := c.CloseRead(r.Context())
+	err = s.watch(ctx, kioskID, lastEventID, sub, func(update signUpdate) error {
+		data, err := eventMarshaler.Marshal(update.response())
+		if err != nil {
+			return err
+		}
+		message, err := json.Marshal(&watchEvent{ID: update.eventID, Data: data})
+		if err != nil {
+			return err
+		}
+		return c.Write(ctx, websocket.MessageText, message)
+	})
+	if err == errDraining {
+		c.Close(websocket.StatusServiceRestart, "server is shutting down")
+	} else if err == nil {
+		c.Close(websocket.StatusNormalClosure, "")
+	}
+}
+
+// watch calls send with the current sign for a kiosk and the other updates
+// that sub asks for, and then with every change to them, until ctx is done,
+// the session lifetime expires, send fails or the server drains. Commands
+// are marked delivered once they are sent. The current sign is skipped if
+// it hasn't changed since lastEventID, but the signs of regions are always
+// sent again, since region changes can have lower event ids than the last
+// event a client saw.
+func (s *DisplayServer) watch(ctx context.Context, kioskID int32, lastEventID int64, sub subscription, send func(signUpdate) error) error {
+	s.mux.Lock()
+	if err := s.checkStreamQuota(kioskID); err != nil {
+		s.mux.Unlock()
+		return err
+	}
+	updates := s.currentUpdates(kioskID, sub)
+	if lastEventID >= 0 && updates[0].eventID <= lastEventID {
+		updates = updates[1:]
+	}
+	ch := s.subscribe(kioskID, sub)
+	s.mux.Unlock()
+	defer s.unsubscribe(kioskID, ch)
+	for _, update := range updates {
+		if err := send(update); err != nil {
+			return err
+		}
+		s.delivered(kioskID, update.command)
+	}
+	timer := time.NewTimer(s.SessionLifetime)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			return nil
+		case <-s.draining:
+			return errDraining
+		case update := <-ch:
+			if err := send(update); err != nil {
+				return err
+			}
+			s.delivered(kioskID, update.command)
+			observeFanout(update)
+		}
+	}
+}
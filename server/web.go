@@ -0,0 +1,63 @@
+// Copyright 2018 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"google.golang.org/grpc"
+)
+
+// NewWebHandler returns an HTTP handler that serves gRPC-Web requests with
+// grpcServer and passes all other requests to next. gRPC-Web responses are
+// flushed as they are written, so server-streaming methods such as
+// GetSignIdsForKioskId also work over HTTP/1.1. Cross-origin requests are
+// accepted from origins for which allowed returns true.
+func NewWebHandler(grpcServer *grpc.Server, next http.Handler, allowed func(origin string) bool) http.Handler {
+	wrapped := grpcweb.WrapServer(grpcServer,
+		grpcweb.WithOriginFunc(allowed),
+		grpcweb.WithWebsockets(true),
+		grpcweb.WithWebsocketOriginFunc(func(r *http.Request) bool {
+			return allowed(r.Header.Get("Origin"))
+		}),
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wrapped.IsGrpcWebRequest(r) ||
+			wrapped.IsGrpcWebSocketRequest(r) ||
+			wrapped.IsAcceptableGrpcCorsRequest(r) {
+			wrapped.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// originAllowed returns a function that reports whether a browser origin is
+// in a comma-separated list of allowed origins. "*" allows any origin.
+// Requests without an Origin header come from the same origin and are
+// always allowed.
+func originAllowed(allowedOrigins string) func(origin string) bool {
+	origins := make(map[string]bool)
+	for _, o := range strings.Split(allowedOrigins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins[strings.TrimSuffix(o, "/")] = true
+		}
+	}
+	return func(origin string) bool {
+		return origin == "" || origins["*"] || origins[origin]
+	}
+}
@@ -0,0 +1,337 @@
+/*
+ * Copyright 2018, Google LLC. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import SwiftGRPC
+import SwiftProtobuf
+
+// This server only implements the basic kiosk, sign and assignment methods.
+// The rest of the Display service is answered with `.unimplemented`; see the
+// Go server for a complete implementation.
+extension KioskProvider {
+  func unimplemented(_ method: String) -> ServerStatus {
+    return ServerStatus(code: .unimplemented, message: "\(method) is not implemented by this server.")
+  }
+
+  func updateKiosk(request: Kiosk_Kiosk,
+                   session: Kiosk_DisplayUpdateKioskSession) throws ->
+    Kiosk_Kiosk {
+      throw unimplemented("UpdateKiosk")
+  }
+
+  func undeleteKiosk(request: Kiosk_UndeleteKioskRequest,
+                     session: Kiosk_DisplayUndeleteKioskSession) throws ->
+    Kiosk_Kiosk {
+      throw unimplemented("UndeleteKiosk")
+  }
+
+  func updateSign(request: Kiosk_Sign,
+                  session: Kiosk_DisplayUpdateSignSession) throws ->
+    Kiosk_Sign {
+      throw unimplemented("UpdateSign")
+  }
+
+  func undeleteSign(request: Kiosk_UndeleteSignRequest,
+                    session: Kiosk_DisplayUndeleteSignSession) throws ->
+    Kiosk_Sign {
+      throw unimplemented("UndeleteSign")
+  }
+
+  func batchCreateKiosks(request: Kiosk_BatchCreateKiosksRequest,
+                         session: Kiosk_DisplayBatchCreateKiosksSession) throws ->
+    Kiosk_BatchCreateKiosksResponse {
+      throw unimplemented("BatchCreateKiosks")
+  }
+
+  func batchGetKiosks(request: Kiosk_BatchGetKiosksRequest,
+                      session: Kiosk_DisplayBatchGetKiosksSession) throws ->
+    Kiosk_BatchGetKiosksResponse {
+      throw unimplemented("BatchGetKiosks")
+  }
+
+  func batchDeleteKiosks(request: Kiosk_BatchDeleteKiosksRequest,
+                         session: Kiosk_DisplayBatchDeleteKiosksSession) throws ->
+    Kiosk_BatchDeleteKiosksResponse {
+      throw unimplemented("BatchDeleteKiosks")
+  }
+
+  func batchCreateSigns(request: Kiosk_BatchCreateSignsRequest,
+                        session: Kiosk_DisplayBatchCreateSignsSession) throws ->
+    Kiosk_BatchCreateSignsResponse {
+      throw unimplemented("BatchCreateSigns")
+  }
+
+  func batchGetSigns(request: Kiosk_BatchGetSignsRequest,
+                     session: Kiosk_DisplayBatchGetSignsSession) throws ->
+    Kiosk_BatchGetSignsResponse {
+      throw unimplemented("BatchGetSigns")
+  }
+
+  func batchDeleteSigns(request: Kiosk_BatchDeleteSignsRequest,
+                        session: Kiosk_DisplayBatchDeleteSignsSession) throws ->
+    Kiosk_BatchDeleteSignsResponse {
+      throw unimplemented("BatchDeleteSigns")
+  }
+
+  func listSignRevisions(request: Kiosk_ListSignRevisionsRequest,
+                         session: Kiosk_DisplayListSignRevisionsSession) throws ->
+    Kiosk_ListSignRevisionsResponse {
+      throw unimplemented("ListSignRevisions")
+  }
+
+  func getSignRevision(request: Kiosk_GetSignRevisionRequest,
+                       session: Kiosk_DisplayGetSignRevisionSession) throws ->
+    Kiosk_SignRevision {
+      throw unimplemented("GetSignRevision")
+  }
+
+  func rollbackSign(request: Kiosk_RollbackSignRequest,
+                    session: Kiosk_DisplayRollbackSignSession) throws ->
+    Kiosk_Sign {
+      throw unimplemented("RollbackSign")
+  }
+
+  func createSignTemplate(request: Kiosk_SignTemplate,
+                          session: Kiosk_DisplayCreateSignTemplateSession) throws ->
+    Kiosk_SignTemplate {
+      throw unimplemented("CreateSignTemplate")
+  }
+
+  func listSignTemplates(request: SwiftProtobuf.Google_Protobuf_Empty,
+                         session: Kiosk_DisplayListSignTemplatesSession) throws ->
+    Kiosk_ListSignTemplatesResponse {
+      throw unimplemented("ListSignTemplates")
+  }
+
+  func getSignTemplate(request: Kiosk_GetSignTemplateRequest,
+                       session: Kiosk_DisplayGetSignTemplateSession) throws ->
+    Kiosk_SignTemplate {
+      throw unimplemented("GetSignTemplate")
+  }
+
+  func updateSignTemplate(request: Kiosk_SignTemplate,
+                          session: Kiosk_DisplayUpdateSignTemplateSession) throws ->
+    Kiosk_SignTemplate {
+      throw unimplemented("UpdateSignTemplate")
+  }
+
+  func deleteSignTemplate(request: Kiosk_DeleteSignTemplateRequest,
+                          session: Kiosk_DisplayDeleteSignTemplateSession) throws ->
+    SwiftProtobuf.Google_Protobuf_Empty {
+      throw unimplemented("DeleteSignTemplate")
+  }
+
+  func setDataValue(request: Kiosk_DataValue,
+                    session: Kiosk_DisplaySetDataValueSession) throws ->
+    Kiosk_DataValue {
+      throw unimplemented("SetDataValue")
+  }
+
+  func listDataValues(request: SwiftProtobuf.Google_Protobuf_Empty,
+                      session: Kiosk_DisplayListDataValuesSession) throws ->
+    Kiosk_ListDataValuesResponse {
+      throw unimplemented("ListDataValues")
+  }
+
+  func getDataValue(request: Kiosk_GetDataValueRequest,
+                    session: Kiosk_DisplayGetDataValueSession) throws ->
+    Kiosk_DataValue {
+      throw unimplemented("GetDataValue")
+  }
+
+  func deleteDataValue(request: Kiosk_DeleteDataValueRequest,
+                       session: Kiosk_DisplayDeleteDataValueSession) throws ->
+    SwiftProtobuf.Google_Protobuf_Empty {
+      throw unimplemented("DeleteDataValue")
+  }
+
+  func createLayout(request: Kiosk_Layout,
+                    session: Kiosk_DisplayCreateLayoutSession) throws ->
+    Kiosk_Layout {
+      throw unimplemented("CreateLayout")
+  }
+
+  func listLayouts(request: SwiftProtobuf.Google_Protobuf_Empty,
+                   session: Kiosk_DisplayListLayoutsSession) throws ->
+    Kiosk_ListLayoutsResponse {
+      throw unimplemented("ListLayouts")
+  }
+
+  func getLayout(request: Kiosk_GetLayoutRequest,
+                 session: Kiosk_DisplayGetLayoutSession) throws ->
+    Kiosk_Layout {
+      throw unimplemented("GetLayout")
+  }
+
+  func deleteLayout(request: Kiosk_DeleteLayoutRequest,
+                    session: Kiosk_DisplayDeleteLayoutSession) throws ->
+    SwiftProtobuf.Google_Protobuf_Empty {
+      throw unimplemented("DeleteLayout")
+  }
+
+  func setKioskLayout(request: Kiosk_KioskLayout,
+                      session: Kiosk_DisplaySetKioskLayoutSession) throws ->
+    Kiosk_KioskLayout {
+      throw unimplemented("SetKioskLayout")
+  }
+
+  func getKioskLayout(request: Kiosk_GetKioskLayoutRequest,
+                      session: Kiosk_DisplayGetKioskLayoutSession) throws ->
+    Kiosk_KioskLayout {
+      throw unimplemented("GetKioskLayout")
+  }
+
+  func getEffectiveSign(request: Kiosk_GetEffectiveSignRequest,
+                        session: Kiosk_DisplayGetEffectiveSignSession) throws ->
+    Kiosk_Sign {
+      throw unimplemented("GetEffectiveSign")
+  }
+
+  func reportKioskStatus(request: Kiosk_ReportKioskStatusRequest,
+                         session: Kiosk_DisplayReportKioskStatusSession) throws ->
+    SwiftProtobuf.Google_Protobuf_Empty {
+      throw unimplemented("ReportKioskStatus")
+  }
+
+  func reportPlays(request: Kiosk_ReportPlaysRequest,
+                   session: Kiosk_DisplayReportPlaysSession) throws ->
+    SwiftProtobuf.Google_Protobuf_Empty {
+      throw unimplemented("ReportPlays")
+  }
+
+  func queryPlayReports(request: Kiosk_QueryPlayReportsRequest,
+                        session: Kiosk_DisplayQueryPlayReportsSession) throws ->
+    Kiosk_QueryPlayReportsResponse {
+      throw unimplemented("QueryPlayReports")
+  }
+
+  func kioskSession(session: Kiosk_DisplayKioskSessionSession) throws -> ServerStatus? {
+    throw unimplemented("KioskSession")
+  }
+
+  func sendKioskCommand(request: Kiosk_KioskCommand,
+                        session: Kiosk_DisplaySendKioskCommandSession) throws ->
+    Kiosk_KioskCommand {
+      throw unimplemented("SendKioskCommand")
+  }
+
+  func listKioskCommands(request: Kiosk_ListKioskCommandsRequest,
+                         session: Kiosk_DisplayListKioskCommandsSession) throws ->
+    Kiosk_ListKioskCommandsResponse {
+      throw unimplemented("ListKioskCommands")
+  }
+
+  func getKioskCommand(request: Kiosk_GetKioskCommandRequest,
+                       session: Kiosk_DisplayGetKioskCommandSession) throws ->
+    Kiosk_KioskCommand {
+      throw unimplemented("GetKioskCommand")
+  }
+
+  func reportCommandResult(request: Kiosk_ReportCommandResultRequest,
+                           session: Kiosk_DisplayReportCommandResultSession) throws ->
+    Kiosk_KioskCommand {
+      throw unimplemented("ReportCommandResult")
+  }
+
+  func emergencyOverride(request: Kiosk_EmergencyOverrideRequest,
+                         session: Kiosk_DisplayEmergencyOverrideSession) throws ->
+    Kiosk_Override {
+      throw unimplemented("EmergencyOverride")
+  }
+
+  func listEmergencyOverrides(request: SwiftProtobuf.Google_Protobuf_Empty,
+                              session: Kiosk_DisplayListEmergencyOverridesSession) throws ->
+    Kiosk_ListEmergencyOverridesResponse {
+      throw unimplemented("ListEmergencyOverrides")
+  }
+
+  func clearEmergencyOverride(request: Kiosk_ClearEmergencyOverrideRequest,
+                              session: Kiosk_DisplayClearEmergencyOverrideSession) throws ->
+    Kiosk_Override {
+      throw unimplemented("ClearEmergencyOverride")
+  }
+
+  func getKioskManifest(request: Kiosk_GetKioskManifestRequest,
+                        session: Kiosk_DisplayGetKioskManifestSession) throws ->
+    Kiosk_KioskManifest {
+      throw unimplemented("GetKioskManifest")
+  }
+
+  func uploadScreenshot(request: Kiosk_Screenshot,
+                        session: Kiosk_DisplayUploadScreenshotSession) throws ->
+    Kiosk_Screenshot {
+      throw unimplemented("UploadScreenshot")
+  }
+
+  func listScreenshots(request: Kiosk_ListScreenshotsRequest,
+                       session: Kiosk_DisplayListScreenshotsSession) throws ->
+    Kiosk_ListScreenshotsResponse {
+      throw unimplemented("ListScreenshots")
+  }
+
+  func getScreenshot(request: Kiosk_GetScreenshotRequest,
+                     session: Kiosk_DisplayGetScreenshotSession) throws ->
+    Kiosk_Screenshot {
+      throw unimplemented("GetScreenshot")
+  }
+
+  func createRollout(request: Kiosk_Rollout,
+                     session: Kiosk_DisplayCreateRolloutSession) throws ->
+    Kiosk_Rollout {
+      throw unimplemented("CreateRollout")
+  }
+
+  func listRollouts(request: Kiosk_ListRolloutsRequest,
+                    session: Kiosk_DisplayListRolloutsSession) throws ->
+    Kiosk_ListRolloutsResponse {
+      throw unimplemented("ListRollouts")
+  }
+
+  func getRollout(request: Kiosk_GetRolloutRequest,
+                  session: Kiosk_DisplayGetRolloutSession) throws ->
+    Kiosk_Rollout {
+      throw unimplemented("GetRollout")
+  }
+
+  func advanceRollout(request: Kiosk_AdvanceRolloutRequest,
+                      session: Kiosk_DisplayAdvanceRolloutSession) throws ->
+    Kiosk_Rollout {
+      throw unimplemented("AdvanceRollout")
+  }
+
+  func pauseRollout(request: Kiosk_PauseRolloutRequest,
+                    session: Kiosk_DisplayPauseRolloutSession) throws ->
+    Kiosk_Rollout {
+      throw unimplemented("PauseRollout")
+  }
+
+  func resumeRollout(request: Kiosk_ResumeRolloutRequest,
+                     session: Kiosk_DisplayResumeRolloutSession) throws ->
+    Kiosk_Rollout {
+      throw unimplemented("ResumeRollout")
+  }
+
+  func abortRollout(request: Kiosk_AbortRolloutRequest,
+                    session: Kiosk_DisplayAbortRolloutSession) throws ->
+    Kiosk_Rollout {
+      throw unimplemented("AbortRollout")
+  }
+
+  func listAuditEvents(request: Kiosk_ListAuditEventsRequest,
+                       session: Kiosk_DisplayListAuditEventsSession) throws ->
+    Kiosk_ListAuditEventsResponse {
+      throw unimplemented("ListAuditEvents")
+  }
+}
@@ -47,7 +47,7 @@ class KioskProvider: Kiosk_DisplayProvider {
       }
   }
   
-  func listKiosks(request: SwiftProtobuf.Google_Protobuf_Empty,
+  func listKiosks(request: Kiosk_ListKiosksRequest,
                   session: Kiosk_DisplayListKiosksSession) throws ->
     Kiosk_ListKiosksResponse {
       return queue.sync {
@@ -99,7 +99,7 @@ class KioskProvider: Kiosk_DisplayProvider {
       }
   }
   
-  func listSigns(request: SwiftProtobuf.Google_Protobuf_Empty,
+  func listSigns(request: Kiosk_ListSignsRequest,
                  session: Kiosk_DisplayListSignsSession) throws ->
     Kiosk_ListSignsResponse {
       return queue.sync {
@@ -134,7 +134,7 @@ class KioskProvider: Kiosk_DisplayProvider {
   
   func setSignIdForKioskIds(request: Kiosk_SetSignIdForKioskIdsRequest,
                             session: Kiosk_DisplaySetSignIdForKioskIdsSession) throws ->
-    SwiftProtobuf.Google_Protobuf_Empty {
+    Kiosk_SetSignIdForKioskIdsResponse {
       return try queue.sync {
         if self.signs[request.signID] == nil {
           throw ServerStatus(code: .notFound, message: "No sign with that ID found.")
@@ -143,14 +143,20 @@ class KioskProvider: Kiosk_DisplayProvider {
         let kioskIDsToChange = !request.kioskIds.isEmpty
           ? request.kioskIds
           : Array(self.kiosks.keys)
+        var response = Kiosk_SetSignIdForKioskIdsResponse()
         for id in kioskIDsToChange {
+          if self.signIdsForKioskIds[id] == request.signID {
+            response.unchangedKioskIds.append(id)
+            continue
+          }
           self.signIdsForKioskIds[id] = request.signID
+          response.changedKioskIds.append(id)
 
           for block in self.subscribersForKioskIds[id, default: [:]].values {
             block(request.signID)
           }
         }
-        return SwiftProtobuf.Google_Protobuf_Empty()
+        return response
       }
   }
   
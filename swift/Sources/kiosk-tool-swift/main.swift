@@ -48,7 +48,7 @@ Group {
              description: "List kiosks.")
   {
     let service = buildServiceClient()
-    let response = try service.listKiosks(SwiftProtobuf.Google_Protobuf_Empty())
+    let response = try service.listKiosks(Kiosk_ListKiosksRequest())
     print("\(response)")
   }
   
@@ -95,7 +95,7 @@ Group {
              description: "List signs.")
   {
     let service = buildServiceClient()
-    var response = try service.listSigns(SwiftProtobuf.Google_Protobuf_Empty())
+    var response = try service.listSigns(Kiosk_ListSignsRequest())
     for i in 0..<response.signs.count {
       if response.signs[i].image.count > 10 {
         response.signs[i].image = response.signs[i].image[0..<10]